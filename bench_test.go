@@ -1,8 +1,11 @@
 package websocket
 
 import (
+	"bytes"
+	"fmt"
 	"io"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -79,6 +82,35 @@ func BenchmarkReceive(b *testing.B) {
 		}
 	})
 
+	b.Run("new", func(b *testing.B) {
+		b.SetBytes(int64(messageSize / messageCount))
+		b.ReportAllocs()
+
+		conn := dialListener(b, ln)
+		for i := 0; i < b.N; i++ {
+			_, buf, err := conn.ReceivePooled(100*1024, time.Second, time.Second)
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn.ReleaseBuffer(buf)
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.SetBytes(int64(messageSize / messageCount))
+		b.ReportAllocs()
+
+		conn := dialListener(b, ln)
+		conn.MessageBufferPool = new(sync.Pool)
+		for i := 0; i < b.N; i++ {
+			_, buf, err := conn.ReceivePooled(100*1024, time.Second, time.Second)
+			if err != nil {
+				b.Fatal(err)
+			}
+			conn.ReleaseBuffer(buf)
+		}
+	})
+
 	b.Run("tcp", func(b *testing.B) {
 		b.SetBytes(int64(messageSize / messageCount))
 		b.ReportAllocs()
@@ -170,6 +202,24 @@ func BenchmarkSend(b *testing.B) {
 		}
 	})
 
+	b.Run("copy", func(b *testing.B) {
+		b.SetBytes(int64(messageSize / messageCount))
+		b.ReportAllocs()
+
+		conn := dialListener(b, ln)
+		for i := 0; i < b.N; i++ {
+			w := conn.SendStream(opcodes[i%len(opcodes)], time.Millisecond)
+			// hide io.WriterTo from bytes.Reader
+			_, err := io.Copy(w, struct{ io.Reader }{bytes.NewReader(messages[i%len(messages)])})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
 	b.Run("tcp", func(b *testing.B) {
 		b.SetBytes(int64(messageSize / messageCount))
 		b.ReportAllocs()
@@ -185,6 +235,51 @@ func BenchmarkSend(b *testing.B) {
 	})
 }
 
+func BenchmarkStreamFragments(b *testing.B) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// drain testEnd
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for err == nil {
+					_, err = conn.Read(buf)
+				}
+			}()
+		}
+	}()
+
+	fragment := make([]byte, 32)
+	for _, coalesce := range []int{0, 1024} {
+		b.Run(fmt.Sprintf("coalesce%d", coalesce), func(b *testing.B) {
+			b.SetBytes(int64(len(fragment)) * 64)
+			b.ReportAllocs()
+
+			conn := dialListener(b, ln)
+			conn.StreamCoalesce = coalesce
+			for i := 0; i < b.N; i++ {
+				w := conn.SendStream(Binary, time.Second)
+				for j := 0; j < 64; j++ {
+					if _, err := w.Write(fragment); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func dialListener(tb testing.TB, ln net.Listener) *Conn {
 	c, err := net.Dial("tcp", ln.Addr().String())
 	if err != nil {
@@ -192,3 +287,24 @@ func dialListener(tb testing.TB, ln net.Listener) *Conn {
 	}
 	return &Conn{Conn: c}
 }
+
+func BenchmarkMask(b *testing.B) {
+	const word = 0x1234567812345678
+
+	for _, size := range []int{maskUnrollMin, 1 << 10, 1 << 20} {
+		p := make([]byte, size)
+
+		b.Run(fmt.Sprintf("%dB/words", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				maskWords(p, word)
+			}
+		})
+		b.Run(fmt.Sprintf("%dB/unrolled", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				maskWords(maskWords32(p, word), word)
+			}
+		})
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"math/bits"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 // first (frame) byte layout
@@ -19,6 +21,13 @@ const (
 	finalFlag    = 0x80
 )
 
+// ReadPendingFlag in Conn.readHead signals remaining payload.
+const readPendingFlag = 0x100
+
+// ReadPeekFlag in Conn.readHead signals a frame header read ahead by PeekMessage,
+// pending a Read.
+const readPeekFlag = 0x200
+
 // second (frame) byte layout
 const (
 	sizeMask = 0x7f
@@ -29,16 +38,73 @@ const (
 	// distinguish between the zero value
 	statusCodeSetFlag = 0x10000
 	statusCodeMask    = 0xffff
+	// index in violations
+	causeShift = 24
+)
+
+// Protocol violations from the peer, as reported by Conn.CloseCause.
+var (
+	ErrNoMask       = errors.New("websocket: frame without mask")
+	ErrOpcode       = errors.New("websocket: frame opcode not accepted")
+	ErrFrameSize    = errors.New("websocket: frame size exceeds word size")
+	ErrCtrlFragment = errors.New("websocket: control frame not final")
+	ErrCtrlSize     = errors.New("websocket: control frame payload exceeds limit")
+	ErrContinuation = errors.New("websocket: continuation frame without message")
+	ErrInterruption = errors.New("websocket: fragmented message interrupted")
+	ErrCloseReason  = errors.New("websocket: close reason not UTF-8")
+)
+
+// Violations is a table of causes, indexed by the cause constants.
+var violations = [...]error{
+	causeNoMask:       ErrNoMask,
+	causeReserved:     ErrReserved,
+	causeOpcode:       ErrOpcode,
+	causeFrameSize:    ErrFrameSize,
+	causeCtrlFragment: ErrCtrlFragment,
+	causeCtrlSize:     ErrCtrlSize,
+	causeContinuation: ErrContinuation,
+	causeInterrupted:  ErrInterruption,
+	causeCloseReason:  ErrCloseReason,
+}
+
+// Cause constants index violations.
+const (
+	_ = iota // no cause
+	causeNoMask
+	causeReserved
+	causeOpcode
+	causeFrameSize
+	causeCtrlFragment
+	causeCtrlSize
+	causeContinuation
+	causeInterrupted
+	causeCloseReason
 )
 
 var byteOrder = binary.BigEndian
 
-// ErrRetry rejects a write. See method documentation!
-var errRetry = errors.New("websocket: retry after error with differend payload size")
+// ErrRetry rejects a write while a frame from a previous Write is pending. The
+// retry after a Write error must continue with the same payload, minus the
+// number of bytes done. ErrRetry signals a violation of this contract, without
+// any effect on the connection.
+var ErrRetry = errors.New("websocket: retry after error with differend payload size")
 
 // AcceptV13 is a Conn.Accept value for all non-reserved opcodes from version 13.
 const AcceptV13 = 1<<Continuation | 1<<Text | 1<<Binary | 1<<Close | 1<<Ping | 1<<Pong
 
+// AcceptOpcodes returns a Conn.Accept value which permits each opcode. It panics
+// on opcodes out of range [0, 15].
+func AcceptOpcodes(opcodes ...uint) uint {
+	var mask uint
+	for _, opcode := range opcodes {
+		if opcode > opcodeMask {
+			panic(fmt.Sprintf("websocket: opcode %d out of range [0, 15]", opcode))
+		}
+		mask |= 1 << opcode
+	}
+	return mask
+}
+
 // Conn offers a low-level network abstraction confrom the net.Conn interface.
 // Conn also offers high-level protocol abstraction with the Receive and Send
 // methods. These operations offer network error recovery, timeout protection
@@ -50,33 +116,198 @@ const AcceptV13 = 1<<Continuation | 1<<Text | 1<<Binary | 1<<Close | 1<<Ping | 1
 // when Read got io.EOF without any Close frame occurrence.
 //
 // Connections must be read consecutively for correct operation and closure.
+//
+// The high-level methods manage the deadlines of the embedded net.Conn. Read
+// deadlines are set by the receive methods, which run sequentially. Write
+// deadlines are set before each frame transmission, including any Pong reply,
+// while holding the write lock. The two never interfere, which makes concurrent
+// Send and Receive safe. Deadlines set by the caller, with SetDeadline,
+// SetReadDeadline or SetWriteDeadline, act as a ceiling. The high-level methods
+// use the earlier of their own timeout and any such ceiling, until the ceiling
+// is cleared with a zero deadline.
+//
+// The embedded net.Conn is the transport. Direct use of its Read and Write, as
+// in c.Conn.Read, bypasses the frame layer and corrupts the connection state.
+// See NetConn for legitimate use.
 type Conn struct {
 	net.Conn
 
+	// Statistics for use with package sync/atomic only. The 64-bit words
+	// are placed directly after net.Conn for alignment.
+	readByteN, writeByteN       uint64
+	readFrameN, writeFrameN     uint64
+	readMessageN, writeMessageN uint64
+	readPingN, writePingN       uint64
+	readPongN, writePongN       uint64
+	// Unix time in nanoseconds, or zero for none.
+	pongDeadline int64
+	// Deadline ceilings, in Unix time nanoseconds, or zero for none.
+	readCeiling, writeCeiling int64
+
 	// When not zero, then receival of opcodes without a flag are rejected
 	// with a connection Close, status code 1003—CannotAccept. Flags follow
-	// little-endian bit order as in 1 << opcode. Use AcceptV13 to disable
-	// all reserved opcodes.
+	// little-endian bit order as in 1 << opcode. The zero value rejects all
+	// reserved opcodes with a connection Close, status code 1002—Protocol
+	// Error, as required without extension negotiated. Reserved opcodes are
+	// permitted only with their respective flag set.
 	Accept uint
 
+	// Reserved bits in the mask are permitted on receival. Frames with any
+	// other reserved bit set are rejected with a connection Close, status
+	// code 1002—ProtocolError. Bits follow the first frame byte, i.e., 0x40
+	// for RSV1, 0x20 for RSV2 and 0x10 for RSV3. The zero value rejects all
+	// reserved bits, as required without extension negotiated.
+	ReservedBits uint
+
+	// Control frames received with a payload beyond the limit are rejected
+	// with a connection Close, status code 1002—ProtocolError. The zero
+	// value defaults to the protocol limit of 125 bytes, which also caps
+	// any higher value.
+	MaxControlPayload int
+
+	// When not zero, then the connection is closed with status code 1008—
+	// Policy, once the number of bytes read exceeds the limit. The count
+	// includes frame headers and control frames, like ConnStats.ReadBytes
+	// does, which makes it a quota for the entire lifetime of the connection
+	// rather than a limit on individual messages.
+	TotalReadLimit int64
+
+	// When not nil, then each control frame received in between the frames
+	// of a ReceiveStream message is passed to the listener, before it gets
+	// dealed with. The payload is valid for the duration of the call only.
+	StreamCtrlListener func(opcode uint, payload []byte)
+
+	// When not nil, then a Close from the peer is replied with the status
+	// code and reason from the hook, instead of an echo of the ones
+	// received. Received status code 1005 [NoStatusCode] means that the
+	// peer sent none, and a reply with 1005 omits the status code in turn.
+	// The status code received remains in effect for the connection, as
+	// seen with ClosedError and Stats. The hook runs in the read routine,
+	// so it must not block.
+	//
+	// “If an endpoint receives a Close frame and did not previously send
+	// a Close frame, the endpoint MUST send a Close frame in response.
+	// (When sending a Close frame in response, the endpoint typically
+	// echos the status code it received.)”
+	// — “The WebSocket Protocol” RFC 6455, subsection 5.5.1
+	CloseReply func(statusCode uint, reason string) (replyCode uint, replyReason string)
+
+	// When set, then the io.Reader from ReceiveStream returns expiry of the
+	// wire timeout as a net.Error with Timeout, without closing the
+	// connection. The message remains in progress, such that the caller
+	// may decide to Read again, or to close the connection. An expired
+	// pong deadline closes the connection regardless.
+	StreamTimeoutRecoverable bool
+
+	// Temporary errors from the network are retried by the high-level
+	// methods, with an exponential backoff, until the sum of delays exceeds
+	// the limit. The connection is marked closed with status code 1006—
+	// AbnormalClose on expiry, and the error return is the last one from
+	// the network. The zero value defaults to 10 seconds.
+	RetryLimit time.Duration
+
+	// When not nil, then ReceivePooled and ServeMessages borrow their
+	// message buffers from the pool, as *bytes.Buffer. The pool may be
+	// shared among connections.
+	MessageBufferPool *sync.Pool
+
+	// Transmission time limit for WriteText and WriteBinary. The zero value
+	// disables the limit.
+	WriteTimeout time.Duration
+
+	// Frame receival time limit for ReadMessage, as the wireTimeout of
+	// Receive. The zero value disables the limit. Methods with a timeout
+	// argument ignore WriteTimeout, WireTimeout and IdleTimeout.
+	WireTimeout time.Duration
+
+	// Time limit on arrival for ReadMessage, as the idleTimeout of Receive.
+	// The zero value disables the limit.
+	IdleTimeout time.Duration
+
+	// When set, then Send, SendBuffers and WriteText reject Text with an
+	// illegal UTF-8 sequence with ErrUTF8, before any transmission. The
+	// streams from SendStream validate Text regardless.
+	ValidateOutgoingText bool
+
+	// When not zero, then the streams from SendStream buffer their writes
+	// up to the size in bytes, to send fewer (larger) frames. The buffer is
+	// retained by the connection for reuse.
+	StreamCoalesce int
+
+	// When set, then SendStream corks TCP connections on Linux until the
+	// stream is closed, which packs its frames into fewer TCP segments.
+	// The kernel limits corking to 200 ms. Other platforms and transports
+	// ignore the option.
+	CorkStreams bool
+
+	// When not zero, then the streams from SendStream queue their writes
+	// up to the size in bytes, for transmission in the background. Write
+	// fails with ErrWouldBlock on a full queue, instead of blocking.
+	StreamBufferSize int
+
+	// When set, then the write buffer is borrowed from a package-level
+	// pool for the duration of each write only. Idle connections hold no
+	// write buffer in such case, which saves memory on servers with many
+	// connections.
+	PoolWriteBuffer bool
+
+	// When not nil, then all bytes received and send go to the tap too,
+	// as is, i.e., with frame headers and masks included. The tap sees
+	// chunks as they pass the network, which may split frames. Each Write
+	// holds bytes of one direction only. Inbound and outbound may invoke
+	// the tap simultaneously. Errors from the tap are ignored.
+	FrameTap io.Writer
+
+	// When set, then network reads and frame transmissions exclude each
+	// other, for peers which can't deal with simultaneous traffic in both
+	// directions. A receive which waits for data blocks any send until
+	// data arrives or its deadline expires, and vice versa. Throughput
+	// drops accordingly. The option must not change once in use.
+	HalfDuplex bool
+
 	// read & write lock
 	readMutex, writeMutex sync.Mutex
+	// network I/O lock for HalfDuplex only
+	duplexMutex sync.Mutex
 
 	// pending number of bytes
 	readPayloadN, writePayloadN int
 
-	// first byte of last frame read
+	// first byte of last frame read, with readPendingFlag
 	readHead uint32
+	// Close frame received, read routine only
+	readClose bool
 	// first byte of next frame written
 	writeHead uint32
+	// SendStream in progress, guarded by writeMutex
+	writeStream bool
+	// writeHead expected for SendStream, guarded by writeMutex
+	streamHead uint32
+	// pending SendStream payload, guarded by writeMutex
+	streamBuf []byte
 
 	// read mask byte position
 	maskI uint
 	// read mask key
-	mask uint64
+	mask uint32
+
+	// reused by ReceiveStream
+	messageReader messageReader
+	textReader    textReader
+
+	// installed for ServeMessages
+	textHandler   func(message string) error
+	binaryHandler func(message []byte) error
 
 	// set once a close frame is send or received.
 	statusCode uint32
+	// closed on statusCode set, guarded by closeMutex
+	closeWait chan struct{}
+	// callbacks pending statusCode set, guarded by closeMutex
+	onClose []func(ClosedError)
+	// reason from the Close received, guarded by closeMutex
+	remoteReason string
+	closeMutex   sync.Mutex
 
 	// Pending number of bytes in buffer.
 	readBufN, writeBufN int
@@ -84,12 +315,202 @@ type Conn struct {
 	readBufDone int
 	// Read buffer fits compact frame: 2B header + 4B mask + 125B payload limit
 	readBuf [131]byte
-	// Write buffer fits compact frame: 2B header + 125B payload limit
-	writeBuf [127]byte
+	// Write buffer fits compact frame: 2B header + 125B payload limit.
+	// The buffer is allocated on demand.
+	writeBuf *[127]byte
+}
+
+// NewConn returns a connection which reads the buffered bytes before any data
+// from conn. The buffered bytes typically come from a bufio.Reader, when a
+// client sent its first frame(s) directly after the handshake request.
+func NewConn(conn net.Conn, buffered []byte) *Conn {
+	c := new(Conn)
+	if len(buffered) <= len(c.readBuf) {
+		c.Conn = conn
+		c.readBufN = copy(c.readBuf[:], buffered)
+	} else {
+		c.Conn = &prefixConn{
+			Conn:   conn,
+			prefix: append([]byte(nil), buffered...),
+		}
+	}
+	return c
+}
+
+// Reset binds the connection to conn, with all state cleared as if it was new,
+// including the statistics and the status code. Configuration fields remain as
+// is, and so do the handlers from HandleText and HandleBinary. The buffers are
+// retained, which saves allocation when connections come and go in high
+// numbers. Reset must not be invoked while any other method from Conn is in
+// progress, i.e., with any I/O in flight or with any goroutine in
+// WaitClose. OnClose registrations which did not fire yet are discarded.
+func (c *Conn) Reset(conn net.Conn) {
+	*c = Conn{
+		Conn: conn,
+
+		Accept:                   c.Accept,
+		ReservedBits:             c.ReservedBits,
+		MaxControlPayload:        c.MaxControlPayload,
+		TotalReadLimit:           c.TotalReadLimit,
+		StreamCtrlListener:       c.StreamCtrlListener,
+		CloseReply:               c.CloseReply,
+		StreamTimeoutRecoverable: c.StreamTimeoutRecoverable,
+		RetryLimit:               c.RetryLimit,
+		MessageBufferPool:        c.MessageBufferPool,
+		WriteTimeout:             c.WriteTimeout,
+		WireTimeout:              c.WireTimeout,
+		IdleTimeout:              c.IdleTimeout,
+		ValidateOutgoingText:     c.ValidateOutgoingText,
+		StreamCoalesce:           c.StreamCoalesce,
+		CorkStreams:              c.CorkStreams,
+		StreamBufferSize:         c.StreamBufferSize,
+		PoolWriteBuffer:          c.PoolWriteBuffer,
+		FrameTap:                 c.FrameTap,
+		HalfDuplex:               c.HalfDuplex,
+
+		textHandler:   c.textHandler,
+		binaryHandler: c.binaryHandler,
+
+		streamBuf: c.streamBuf[:0],
+		writeBuf:  c.writeBuf,
+	}
+}
+
+// NetConn returns the underlying transport, e.g., to read RemoteAddr or to set
+// socket options. Any Read or Write on the transport corrupts the connection
+// state.
+func (c *Conn) NetConn() net.Conn {
+	if p, ok := c.Conn.(*prefixConn); ok {
+		return p.Conn
+	}
+	return c.Conn
+}
+
+// PrefixConn reads the prefix before any data from the net.Conn.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (n int, err error) {
+	if len(c.prefix) == 0 {
+		return c.Conn.Read(p)
+	}
+	n = copy(p, c.prefix)
+	c.prefix = c.prefix[n:]
+	return n, nil
+}
+
+var writeBufPool = sync.Pool{New: func() interface{} { return new([127]byte) }}
+
+// AcquireWriteBuf ensures a writeBuf is present.
+// The caller must hold the writeMutex lock.
+func (c *Conn) acquireWriteBuf() {
+	if c.writeBuf != nil {
+		return
+	}
+	if c.PoolWriteBuffer {
+		c.writeBuf = writeBufPool.Get().(*[127]byte)
+	} else {
+		c.writeBuf = new([127]byte)
+	}
+}
+
+// ReleaseWriteBuf returns the writeBuf to the pool, if applicable.
+// The caller must hold the writeMutex lock.
+func (c *Conn) releaseWriteBuf() {
+	// pending header must be retained for retries
+	if c.PoolWriteBuffer && c.writeBuf != nil && c.writeBufN <= 0 {
+		writeBufPool.Put(c.writeBuf)
+		c.writeBuf = nil
+	}
 }
 
 func (c *Conn) setClose(statusCode uint, reason string) bool {
-	return atomic.CompareAndSwapUint32(&c.statusCode, 0, uint32(statusCode|statusCodeSetFlag))
+	if !atomic.CompareAndSwapUint32(&c.statusCode, 0, uint32(statusCode|statusCodeSetFlag)) {
+		return false
+	}
+	c.signalClose()
+	return true
+}
+
+// SignalClose releases any WaitClose, and it fires any OnClose. The status code
+// must be set already.
+func (c *Conn) signalClose() {
+	c.closeMutex.Lock()
+	if c.closeWait != nil {
+		close(c.closeWait)
+	}
+	callbacks := c.onClose
+	c.onClose = nil
+	c.closeMutex.Unlock()
+
+	statusCode := ClosedError(atomic.LoadUint32(&c.statusCode) & statusCodeMask)
+	for _, f := range callbacks {
+		go f(statusCode)
+	}
+}
+
+// OnClose registers f to run once a Close frame is either send or received, or
+// once the connection failed otherwise, with the first status code in effect.
+// Each registration fires exactly once, in its own goroutine. Connections which
+// are closed already fire f right away. Multiple goroutines may invoke OnClose
+// simultaneously.
+func (c *Conn) OnClose(f func(ClosedError)) {
+	c.closeMutex.Lock()
+	if statusCode := atomic.LoadUint32(&c.statusCode); statusCode != 0 {
+		c.closeMutex.Unlock()
+		go f(ClosedError(statusCode & statusCodeMask))
+		return
+	}
+	c.onClose = append(c.onClose, f)
+	c.closeMutex.Unlock()
+}
+
+// WaitClose blocks until a Close frame is either send or received, or until the
+// connection failed otherwise. The return has the first status code in effect.
+// Multiple goroutines may invoke WaitClose simultaneously.
+func (c *Conn) WaitClose() ClosedError {
+	c.closeMutex.Lock()
+	if statusCode := atomic.LoadUint32(&c.statusCode); statusCode != 0 {
+		c.closeMutex.Unlock()
+		return ClosedError(statusCode & statusCodeMask)
+	}
+	if c.closeWait == nil {
+		c.closeWait = make(chan struct{})
+	}
+	ch := c.closeWait
+	c.closeMutex.Unlock()
+
+	<-ch
+	return ClosedError(atomic.LoadUint32(&c.statusCode) & statusCodeMask)
+}
+
+// CloseCode returns the status code in effect, if closed. The code is the first
+// one, either send or received. CloseCode may be invoked simultaneously with any
+// other method from Conn.
+func (c *Conn) CloseCode() (code uint, closed bool) {
+	statusCode := atomic.LoadUint32(&c.statusCode)
+	return uint(statusCode & statusCodeMask), statusCode != 0
+}
+
+// RemoteCloseReason returns the reason from the Close frame received, if any.
+// The reason is at most 123 bytes of UTF-8, conform the control frame limit.
+// RemoteCloseReason may be invoked simultaneously with any other method from
+// Conn.
+func (c *Conn) RemoteCloseReason() string {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	return c.remoteReason
+}
+
+// CloseCause returns the protocol violation from the peer which caused the
+// connection to close, if any. The errors are one of ErrNoMask, ErrReserved,
+// ErrOpcode, ErrFrameSize, ErrCtrlFragment, ErrCtrlSize, ErrContinuation,
+// ErrInterruption and ErrCloseReason. The status code on the wire may be the
+// same for different causes.
+func (c *Conn) CloseCause() error {
+	return violations[atomic.LoadUint32(&c.statusCode)>>causeShift]
 }
 
 // CloseError returns an error if c is closed.
@@ -102,8 +523,11 @@ func (c *Conn) closeError() error {
 }
 
 // SetWriteMode controls the send frame/fragment layout. When final, then each
-// Write sends a message of the given type. The opcode must be in range [1, 15]
-// like Text, Binary or Ping.
+// Write sends a message of the given type. The opcode must be in range [0, 15],
+// where Continuation concludes a fragmented message. Control frames—opcode
+// range [8, 15]—must be final. Reserved opcodes are written as is; their use
+// requires an extension agreed upon with the peer. SetWriteMode panics on
+// opcodes out of range, and on control frames which are not final.
 //
 //	// send two text messages
 //	c.SetWriteMode(websocket.Text, true)
@@ -126,19 +550,28 @@ func (c *Conn) closeError() error {
 // example, in case Copy did not receive any data, then the opcode of the second
 // call to SetWriteMode would apply. Therefore it is recommended to use the same
 // opcode when finalizing a message.
+//
+// SetWriteMode must not be used while a stream from SendStream is in progress.
+// Data frames fail with ErrWriteMode in such case, without any effect, until
+// the stream is closed. Control frames remain permitted.
 func (c *Conn) SetWriteMode(opcode uint, final bool) {
+	if opcode > opcodeMask {
+		panic(fmt.Sprintf("websocket: opcode %d out of range [0, 15]", opcode))
+	}
+	if !final && opcode&ctrlFlag != 0 {
+		panic(fmt.Sprintf("websocket: control frame opcode %d not final", opcode))
+	}
+
 	head := opcode
 	if final {
-		head &= opcodeMask
 		head |= finalFlag
-	} else {
-		head &= opcodeMask &^ ctrlFlag
 	}
 	atomic.StoreUint32(&c.writeHead, uint32(head))
 }
 
 // Write sends p in one frame conform the io.Writer interface. Error retries
-// must continue with the same p(ayload), minus the n(umber) of bytes done.
+// must continue with the same p(ayload), minus the n(umber) of bytes done, or
+// they fail with ErrRetry.
 // Control frames—opcode range [8, 15]—must not exceed 125 bytes.
 // Zero payload causes an empty frame/fragment.
 func (c *Conn) Write(p []byte) (n int, err error) {
@@ -148,21 +581,36 @@ func (c *Conn) Write(p []byte) (n int, err error) {
 	return
 }
 
+// caller must hold the writeMutex lock
 func (c *Conn) write(p []byte) (n int, err error) {
 	if err := c.closeError(); err != nil {
 		return 0, err
 	}
 
+	c.acquireWriteBuf()
+	if c.HalfDuplex {
+		// frame in one go
+		c.duplexMutex.Lock()
+		n, err = c.writeFrame(p)
+		c.duplexMutex.Unlock()
+	} else {
+		n, err = c.writeFrame(p)
+	}
+	c.releaseWriteBuf()
+	return
+}
+
+func (c *Conn) writeFrame(p []byte) (n int, err error) {
 	// pending state/frame
 	if c.writeBufN > 0 || c.writePayloadN > 0 {
 		// inconsistent payload length breaks frame
 		if c.writePayloadN != len(p) {
-			return 0, errRetry
+			return 0, ErrRetry
 		}
 
 		// write frame header
 		if c.writeBufN > 0 {
-			n, err := c.Conn.Write(c.writeBuf[:c.writeBufN])
+			n, err := c.netWrite(c.writeBuf[:c.writeBufN])
 			c.writeBufN -= n
 			if err != nil {
 				// shift out written bytes
@@ -173,14 +621,20 @@ func (c *Conn) write(p []byte) (n int, err error) {
 
 		// write payload
 		if c.writePayloadN > 0 {
-			n, err = c.Conn.Write(p)
+			n, err = c.netWrite(p)
 			c.writePayloadN -= n
 		}
 		return
 	}
 
 	// load buffer with header
-	c.writeBuf[0] = byte(atomic.LoadUint32(&c.writeHead))
+	head := atomic.LoadUint32(&c.writeHead)
+	if c.writeStream && head&ctrlFlag == 0 && head != c.streamHead {
+		// data frame would break the stream
+		return 0, ErrWriteMode
+	}
+	c.writeBuf[0] = byte(head)
+	c.countWriteFrame(uint(c.writeBuf[0]))
 	if len(p) < 126 {
 		// frame fits buffer; send one packet
 		c.writeBuf[1] = byte(len(p))
@@ -201,7 +655,7 @@ func (c *Conn) write(p []byte) (n int, err error) {
 	}
 
 	// send TCP packet
-	n, err = c.Conn.Write(c.writeBuf[:c.writeBufN])
+	n, err = c.netWrite(c.writeBuf[:c.writeBufN])
 	c.writeBufN -= n
 	if err != nil {
 		// shift out written bytes
@@ -209,29 +663,163 @@ func (c *Conn) write(p []byte) (n int, err error) {
 		// undo payload in first TCP package
 		c.writeBufN -= len(p) - c.writePayloadN
 		if c.writeBufN >= 0 {
+			// header pending
+			c.writePayloadN = len(p)
 			return 0, err
 		}
-		return -c.writeBufN, err
+		n = -c.writeBufN
+		c.writeBufN = 0
+		c.writePayloadN = len(p) - n
+		return n, err
 	}
 
 	// send payload remainder if writeBuf size exceeded
 	if c.writePayloadN <= 0 {
 		return len(p), nil
 	}
-	n, err = c.Conn.Write(p[len(p)-c.writePayloadN:])
+	n, err = c.netWrite(p[len(p)-c.writePayloadN:])
 	c.writePayloadN -= n
 	return len(p) - c.writePayloadN, err
 }
 
+// SetPongDeadline fails the connection when no Pong is received by t. Reads
+// after expiry close with status code 1001—GoingAway. The receival of a Pong
+// clears the deadline. A zero value for t clears the deadline too. Use with
+// pings send manually, as in:
+//
+//	c.Send(Ping, nil, time.Second)
+//	c.SetPongDeadline(time.Now().Add(10 * time.Second))
+//
+// The high-level receive methods limit their read deadline to t, while the
+// low-level Read checks t before each frame read only.
+func (c *Conn) SetPongDeadline(t time.Time) {
+	var nano int64
+	if !t.IsZero() {
+		nano = t.UnixNano()
+	}
+	atomic.StoreInt64(&c.pongDeadline, nano)
+}
+
+// PongExpired returns whether the deadline from SetPongDeadline passed.
+func (c *Conn) pongExpired() bool {
+	nano := atomic.LoadInt64(&c.pongDeadline)
+	return nano != 0 && time.Now().UnixNano() >= nano
+}
+
+// SetDeadline sets both the read and the write deadline, conform
+// SetReadDeadline and SetWriteDeadline respectively.
+func (c *Conn) SetDeadline(t time.Time) error {
+	storeCeiling(&c.readCeiling, t)
+	storeCeiling(&c.writeCeiling, t)
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for Read on the underlying connection. The
+// high-level receive methods compute a deadline from their timeouts, and they
+// use the earlier of the two. Thus, t acts as a ceiling for any operation, with
+// control frames and retries included. A zero value for t clears the ceiling.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	storeCeiling(&c.readCeiling, t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for Write on the underlying connection.
+// The high-level send methods compute a deadline from their timeouts, and they
+// use the earlier of the two, like the receive methods do with the deadline
+// from SetReadDeadline. A zero value for t clears the ceiling.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	storeCeiling(&c.writeCeiling, t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// StoreCeiling sets the deadline in Unix time nanoseconds, with zero for none.
+func storeCeiling(ceiling *int64, t time.Time) {
+	var nano int64
+	if !t.IsZero() {
+		nano = t.UnixNano()
+	}
+	atomic.StoreInt64(ceiling, nano)
+}
+
+// LimitDeadline returns the earlier of t and the nanosecond ceiling. The zero
+// value means no deadline for either.
+func limitDeadline(t time.Time, ceiling *int64) time.Time {
+	nano := atomic.LoadInt64(ceiling)
+	if nano != 0 && (t.IsZero() || nano < t.UnixNano()) {
+		return time.Unix(0, nano)
+	}
+	return t
+}
+
+// ReadDeadline returns the deadline for timeout, with zero for noTimeout,
+// limited to any deadline from SetPongDeadline or SetReadDeadline.
+func (c *Conn) readDeadline(timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout != noTimeout {
+		t = time.Now().Add(timeout)
+	}
+	t = limitDeadline(t, &c.pongDeadline)
+	return limitDeadline(t, &c.readCeiling)
+}
+
+// WriteDeadline returns the deadline for timeout, with zero for noTimeout,
+// limited to any deadline from SetWriteDeadline.
+func (c *Conn) writeDeadline(timeout time.Duration) time.Time {
+	var t time.Time
+	if timeout != noTimeout {
+		t = time.Now().Add(timeout)
+	}
+	return limitDeadline(t, &c.writeCeiling)
+}
+
+// NoTimeout is an internal timeout value for no deadline. The timeout arguments
+// from the API can't express no deadline; zero expires immediately.
+const noTimeout = time.Duration(math.MinInt64)
+
+// FieldTimeout returns the timeout for a configuration field like WriteTimeout,
+// which disables the limit with the zero value.
+func fieldTimeout(timeout time.Duration) time.Duration {
+	if timeout == 0 {
+		return noTimeout
+	}
+	return timeout
+}
+
+// ReadTimeout closes the connection on read deadline expiry. The return is a
+// ClosedError, conform SendClose.
+func (c *Conn) readTimeout() error {
+	if c.pongExpired() {
+		return c.SendClose(GoingAway, "pong timeout")
+	}
+	return c.SendClose(Policy, "read timeout")
+}
+
 // ReadMode returns state information about the last Read. Read spans one
-// message at a time. Final indicates that message is received in full.
+// message at a time. Final indicates that message is received in full. Use
+// IsControl to classify the opcode.
 func (c *Conn) ReadMode() (opcode uint, final bool) {
 	head := uint(atomic.LoadUint32(&c.readHead))
 	opcode = head & opcodeMask
-	final = head&finalFlag != 0 && c.readPayloadN == 0
+	final = head&(finalFlag|readPendingFlag) == finalFlag
 	return
 }
 
+// ReadReserved returns the reserved bits of the frame from the last Read, in
+// the layout of ReservedBits. Only bits from ReservedBits can be set.
+func (c *Conn) ReadReserved() uint {
+	return uint(atomic.LoadUint32(&c.readHead)) & reservedMask
+}
+
+// BufferedReadBytes returns the number of bytes received from the network which
+// were not processed yet, like Buffered on Reader. The count includes any frame
+// headers and the payload pending for Read. BufferedReadBytes waits for any read
+// in progress.
+func (c *Conn) BufferedReadBytes() int {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	return c.readBufN - c.readBufDone
+}
+
 // Read receives WebSocket frames confrom the io.Reader interface. ReadMode is
 // updated on each call.
 func (c *Conn) Read(p []byte) (n int, err error) {
@@ -242,14 +830,21 @@ func (c *Conn) Read(p []byte) (n int, err error) {
 }
 
 func (c *Conn) read(p []byte) (n int, err error) {
-	if c.readPayloadN == 0 {
+	if c.pongExpired() {
+		return 0, c.SendClose(GoingAway, "pong timeout")
+	}
+
+	if head := atomic.LoadUint32(&c.readHead); head&readPeekFlag != 0 {
+		// header read ahead
+		atomic.StoreUint32(&c.readHead, head&^readPeekFlag)
+	} else if c.readPayloadN == 0 {
 		err := c.nextFrame()
 		if err != nil {
 			return 0, err
 		}
 	} else {
 		// set opcode to Continue/zero
-		atomic.StoreUint32(&c.readHead, atomic.LoadUint32(&c.readHead)&finalFlag)
+		atomic.StoreUint32(&c.readHead, atomic.LoadUint32(&c.readHead)&(finalFlag|reservedMask|readPendingFlag))
 	}
 
 	// limit read to payload size
@@ -263,11 +858,12 @@ func (c *Conn) read(p []byte) (n int, err error) {
 	// read from network
 	if n < len(p) {
 		var done int
-		done, err = c.Conn.Read(p[n:])
+		done, err = c.netRead(p[n:])
 		n += done
 	}
 	// register result
 	c.readPayloadN -= n
+	c.readPending()
 
 	// deal with payload
 	c.unmaskN(p[:n])
@@ -283,6 +879,13 @@ func (c *Conn) read(p []byte) (n int, err error) {
 }
 
 func (c *Conn) nextFrame() error {
+	if c.readClose {
+		// “The application MUST NOT send any more data frames after
+		// sending a Close frame.”
+		// — “The WebSocket Protocol” RFC 6455, subsection 5.5.1
+		return c.closeError()
+	}
+
 	if c.readBufDone != 0 {
 		// move read ahead to beginning of buffer
 		c.readBufN = copy(c.readBuf[:], c.readBuf[c.readBufDone:c.readBufN])
@@ -291,12 +894,13 @@ func (c *Conn) nextFrame() error {
 
 	err := c.ensureBufN(6)
 	// delay error check for missing mask case
+	var sizeCode int
 	if c.readBufN >= 2 {
 		// second octet contains mask flag and payload size
 		o := int(c.readBuf[1])
-		c.readPayloadN = o & sizeMask
+		sizeCode = o & sizeMask
 		if o&maskFlag == 0 {
-			return c.SendClose(ProtocolError, "no mask")
+			return c.sendClose(ProtocolError, "no mask", causeNoMask)
 		}
 	}
 	if err != nil {
@@ -305,81 +909,167 @@ func (c *Conn) nextFrame() error {
 
 	// first octet contains final flag, reserved bits and opcode
 	head := uint(c.readBuf[0])
+
+	// Header must be complete before any state change. A timeout halfway,
+	// as with StreamTimeoutRecoverable, retries from the start.
+	switch {
+	case head&ctrlFlag != 0:
+		// control frames are buffered in full
+		if sizeCode <= 125 {
+			err = c.ensureBufN(sizeCode + 6)
+		}
+	case sizeCode == 126:
+		err = c.ensureBufN(8)
+	case sizeCode == 127:
+		err = c.ensureBufN(14)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.readPayloadN = sizeCode
 	atomic.StoreUint32(&c.readHead, uint32(head))
+	c.countReadFrame(head)
 
-	if head&reservedMask != 0 {
-		return c.SendClose(ProtocolError, "reserved bit set")
+	if head&reservedMask&^c.ReservedBits != 0 {
+		return c.sendClose(ProtocolError, "reserved bit set", causeReserved)
 	}
 
-	if c.Accept != 0 && c.Accept&(1<<(head&opcodeMask)) == 0 {
-		return c.SendClose(CannotAccept, fmt.Sprintf("opcode %d", head&opcodeMask))
+	if c.Accept == 0 {
+		if AcceptV13&(1<<(head&opcodeMask)) == 0 {
+			return c.sendClose(ProtocolError, fmt.Sprintf("reserved opcode %d", head&opcodeMask), causeOpcode)
+		}
+	} else if c.Accept&(1<<(head&opcodeMask)) == 0 {
+		return c.sendClose(CannotAccept, fmt.Sprintf("opcode %d", head&opcodeMask), causeOpcode)
 	}
 
 	if head&ctrlFlag == 0 {
 		// non-control frame
 		switch c.readPayloadN {
 		default:
-			c.mask = uint64(byteOrder.Uint32(c.readBuf[2:6]))
+			c.mask = byteOrder.Uint32(c.readBuf[2:6])
 			c.readBufDone = 6
 		case 126:
-			if err := c.ensureBufN(8); err != nil {
-				return err
-			}
 			c.readPayloadN = int(byteOrder.Uint16(c.readBuf[2:4]))
-			c.mask = uint64(byteOrder.Uint32(c.readBuf[4:8]))
+			c.mask = byteOrder.Uint32(c.readBuf[4:8])
 			c.readBufDone = 8
 		case 127:
-			if err := c.ensureBufN(14); err != nil {
-				return err
-			}
 			size := byteOrder.Uint64(c.readBuf[2:10])
+			// int conversion must not wrap, e.g., 3 GiB on 32-bit
 			if size > uint64((^uint(0))>>1) {
-				return c.SendClose(TooBig, "word size exceeded")
+				return c.sendClose(TooBig, "word size exceeded", causeFrameSize)
 			}
 			c.readPayloadN = int(size)
-			c.mask = uint64(byteOrder.Uint32(c.readBuf[10:14]))
+			c.mask = byteOrder.Uint32(c.readBuf[10:14])
 			c.readBufDone = 14
 		}
-		c.mask |= c.mask << 32
 		c.maskI = 0
+		c.readPending()
 
 		return nil
 	}
 	// control frame
 
 	if head&finalFlag == 0 {
-		return c.SendClose(ProtocolError, "control frame not final")
+		return c.sendClose(ProtocolError, "control frame not final", causeCtrlFragment)
 	}
 
-	if c.readPayloadN > 125 {
-		return c.SendClose(ProtocolError, "control frame size")
+	if c.readPayloadN > 125 || c.MaxControlPayload != 0 && c.readPayloadN > c.MaxControlPayload {
+		return c.sendClose(ProtocolError, "control frame size", causeCtrlSize)
 	}
 
-	if err := c.ensureBufN(c.readPayloadN + 6); err != nil {
-		return err
-	}
-	c.mask = uint64(byteOrder.Uint32(c.readBuf[2:6]))
-	c.mask |= c.mask << 32
+	c.mask = byteOrder.Uint32(c.readBuf[2:6])
 	c.maskI = 0
 	c.readBufDone = 6
+	c.readPending()
+
+	if head&opcodeMask == Pong {
+		atomic.StoreInt64(&c.pongDeadline, 0)
+	}
 
 	c.unmaskN(c.readBuf[6 : 6+c.readPayloadN])
 
 	if head&opcodeMask == Close {
-		if c.readPayloadN < 2 {
-			return c.SendClose(NoStatusCode, "")
+		c.readClose = true
+		statusCode, reason := uint(NoStatusCode), ""
+		if c.readPayloadN >= 2 {
+			statusCode = uint(byteOrder.Uint16(c.readBuf[6:8]))
+			reason = string(c.readBuf[8 : 6+c.readPayloadN])
+		}
+		// payload consumed; not for Read
+		c.readBufDone += c.readPayloadN
+		c.readPayloadN = 0
+		c.readPending()
+		if !utf8.ValidString(reason) {
+			return c.sendClose(Malformed, "close reason not UTF-8", causeCloseReason)
 		}
-		return c.SendClose(uint(byteOrder.Uint16(c.readBuf[6:8])), string(c.readBuf[8:6+c.readPayloadN]))
+		c.closeMutex.Lock()
+		c.remoteReason = reason
+		c.closeMutex.Unlock()
+		return c.receivedClose(statusCode, reason)
 	}
 
 	return nil
 }
 
+// ReadPending updates readPendingFlag in readHead conform readPayloadN. Only
+// the read routine updates readHead, which makes ReadMode safe to use without
+// readMutex.
+func (c *Conn) readPending() {
+	head := atomic.LoadUint32(&c.readHead) &^ readPendingFlag
+	if c.readPayloadN != 0 {
+		head |= readPendingFlag
+	}
+	atomic.StoreUint32(&c.readHead, head)
+}
+
+// NetRead does a Read on the underlying connection.
+func (c *Conn) netRead(p []byte) (n int, err error) {
+	if c.HalfDuplex {
+		c.duplexMutex.Lock()
+		n, err = c.Conn.Read(p)
+		c.duplexMutex.Unlock()
+	} else {
+		n, err = c.Conn.Read(p)
+	}
+	if c.FrameTap != nil && n > 0 {
+		c.FrameTap.Write(p[:n])
+	}
+	byteN := atomic.AddUint64(&c.readByteN, uint64(n))
+	if c.TotalReadLimit > 0 && byteN > uint64(c.TotalReadLimit) {
+		return n, c.SendClose(Policy, "read limit")
+	}
+	return
+}
+
+// NetWrite does a Write on the underlying connection.
+func (c *Conn) netWrite(p []byte) (n int, err error) {
+	n, err = c.Conn.Write(p)
+	if c.FrameTap != nil && n > 0 {
+		c.FrameTap.Write(p[:n])
+	}
+	atomic.AddUint64(&c.writeByteN, uint64(n))
+	return
+}
+
+// TapWriter copies the bytes written to w into tap, with errors from tap
+// ignored.
+type tapWriter struct{ w, tap io.Writer }
+
+// Write implements the io.Writer interface.
+func (t tapWriter) Write(p []byte) (n int, err error) {
+	n, err = t.w.Write(p)
+	if n > 0 {
+		t.tap.Write(p[:n])
+	}
+	return
+}
+
 // EnsureBufN reads until buf has at least n bytes.
 // Any remaining data is moved to the beginning of the buffer.
 func (c *Conn) ensureBufN(n int) error {
 	for c.readBufN < n {
-		done, err := c.Conn.Read(c.readBuf[c.readBufN:])
+		done, err := c.netRead(c.readBuf[c.readBufN:])
 		c.readBufN += done
 		if err != nil {
 			if err == io.EOF {
@@ -399,24 +1089,5 @@ func (c *Conn) ensureBufN(n int) error {
 }
 
 func (c *Conn) unmaskN(p []byte) {
-	if len(p) < 8 {
-		for i := range p {
-			p[i] ^= byte(c.mask >> ((^c.maskI & 3) * 8))
-			c.maskI++
-		}
-		return
-	}
-
-	word := bits.RotateLeft64(c.mask, int(8*c.maskI))
-
-	var i int
-	for ; len(p)-i > 7; i += 8 {
-		byteOrder.PutUint64(p[i:], byteOrder.Uint64(p[i:])^word)
-	}
-	// multipe of 8 does not change maskI
-
-	for ; i < len(p); i++ {
-		p[i] ^= byte(c.mask >> ((^c.maskI & 3) * 8))
-		c.maskI++
-	}
+	c.maskI = maskWith(p, c.mask, c.maskI)
 }
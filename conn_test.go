@@ -6,6 +6,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/iotest"
 	"time"
@@ -71,6 +72,136 @@ func TestWrite(t *testing.T) {
 	}
 }
 
+// FailWriteConn fails the first write, without any bytes written, and it
+// collects the bytes from any subsequent writes.
+type failWriteConn struct {
+	net.Conn
+	failed bool
+	got    bytes.Buffer
+}
+
+// TemporaryError is a net.Error.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "test temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (c *failWriteConn) Write(p []byte) (int, error) {
+	if !c.failed {
+		c.failed = true
+		return 0, temporaryError{}
+	}
+	return c.got.Write(p)
+}
+
+func (c *failWriteConn) SetWriteDeadline(time.Time) error { return nil }
+
+// TemporaryConn fails all reads and writes with a temporaryError.
+type temporaryConn struct{ net.Conn }
+
+func (temporaryConn) Read([]byte) (int, error)         { return 0, temporaryError{} }
+func (temporaryConn) Write([]byte) (int, error)        { return 0, temporaryError{} }
+func (temporaryConn) SetReadDeadline(time.Time) error  { return nil }
+func (temporaryConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestRetryLimit(t *testing.T) {
+	conn := &Conn{Conn: temporaryConn{}, RetryLimit: time.Millisecond}
+	if err := conn.Send(Binary, []byte("x"), time.Second); err != (temporaryError{}) {
+		t.Errorf("send got error %v, want %v", err, temporaryError{})
+	}
+	if code := conn.Stats().CloseCode; code != AbnormalClose {
+		t.Errorf("got close code %d after send, want %d", code, AbnormalClose)
+	}
+
+	conn = &Conn{Conn: temporaryConn{}, RetryLimit: time.Millisecond}
+	if err := conn.SendBuffers(Binary, net.Buffers{[]byte("x")}, time.Second); err != (temporaryError{}) {
+		t.Errorf("send buffers got error %v, want %v", err, temporaryError{})
+	}
+	if code := conn.Stats().CloseCode; code != AbnormalClose {
+		t.Errorf("got close code %d after send buffers, want %d", code, AbnormalClose)
+	}
+
+	conn = &Conn{Conn: temporaryConn{}, RetryLimit: time.Millisecond}
+	var buf [8]byte
+	if _, _, err := conn.Receive(buf[:], time.Second, time.Second); err != (temporaryError{}) {
+		t.Errorf("receive got error %v, want %v", err, temporaryError{})
+	}
+	if code := conn.Stats().CloseCode; code != AbnormalClose {
+		t.Errorf("got close code %d after receive, want %d", code, AbnormalClose)
+	}
+}
+
+func TestWriteRetry(t *testing.T) {
+	for _, gold := range GoldenFrames[1:] {
+		netConn := new(failWriteConn)
+		conn := &Conn{Conn: netConn}
+		conn.SetWriteMode(gold.Opcode, true)
+
+		n, err := conn.Write([]byte(gold.Message))
+		if err != (temporaryError{}) || n != 0 {
+			t.Fatalf("%#x: got (%d, %v), want (0, %v)", gold.Frame, n, err, temporaryError{})
+		}
+
+		// retry contract violations
+		if _, err := conn.Write([]byte(gold.Message + "!")); err != ErrRetry {
+			t.Errorf("%#x: retry with other size got error %v, want ErrRetry", gold.Frame, err)
+		}
+		if err := conn.Send(gold.Opcode, []byte(gold.Message), time.Second); err != ErrRetry {
+			t.Errorf("%#x: Send got error %v, want ErrRetry", gold.Frame, err)
+		}
+
+		n, err = conn.Write([]byte(gold.Message))
+		if err != nil || n != len(gold.Message) {
+			t.Errorf("%#x: retry got (%d, %v), want (%d, nil)", gold.Frame, n, err, len(gold.Message))
+		}
+		if got := netConn.got.String(); got != gold.Frame {
+			t.Errorf("%#x: got %#x", gold.Frame, got)
+		}
+
+		// connection remains usable
+		netConn.got.Reset()
+		if err := conn.Send(gold.Opcode, []byte(gold.Message), time.Second); err != nil {
+			t.Errorf("%#x: Send after retry got error: %s", gold.Frame, err)
+		}
+		if got := netConn.got.String(); got != gold.Frame {
+			t.Errorf("%#x: Send after retry got %#x", gold.Frame, got)
+		}
+	}
+}
+
+func TestPoolWriteBuffer(t *testing.T) {
+	conn, testEnd := pipeConn()
+	conn.PoolWriteBuffer = true
+
+	done := make(chan *bytes.Buffer)
+	go func() {
+		var got bytes.Buffer
+		got.ReadFrom(testEnd)
+		done <- &got
+	}()
+
+	var want string
+	for _, gold := range GoldenFrames {
+		conn.SetWriteMode(gold.Opcode, true)
+		if _, err := conn.Write([]byte(gold.Message)); err != nil {
+			t.Fatalf("%#x: connection write error: %s", gold.Frame, err)
+		}
+		if conn.writeBuf != nil {
+			t.Errorf("%#x: write buffer retained after write", gold.Frame)
+		}
+		want += gold.Frame
+	}
+
+	if err := conn.Close(); err != nil {
+		t.Error("connection close error:", err)
+	}
+	if got := <-done; got.String() != want {
+		t.Errorf("got %#x", got.String())
+		t.Errorf("want %#x", want)
+	}
+}
+
 func TestRead(t *testing.T) {
 	for _, gold := range GoldenFrames {
 		conn, testEnd := pipeConn()
@@ -122,6 +253,37 @@ func TestRead(t *testing.T) {
 	}
 }
 
+func TestNewConnBuffered(t *testing.T) {
+	for _, gold := range GoldenFrames {
+		testConn, testEnd := net.Pipe()
+		time.AfterFunc(time.Second, func() { testConn.Close() })
+
+		// first half is buffered; second half arrives from test end
+		split := len(gold.Masked) / 2
+		conn := NewConn(testConn, []byte(gold.Masked[:split]))
+		go func() {
+			_, err := io.WriteString(testEnd, gold.Masked[split:])
+			if err != nil {
+				t.Errorf("%#x: test end write error: %s", gold.Masked, err)
+			}
+		}()
+
+		buf := make([]byte, len(gold.Message)+1)
+		opcode, n, err := conn.Receive(buf, time.Second, time.Second)
+		if err != nil {
+			t.Errorf("%#x: receive error: %s", gold.Masked, err)
+			continue
+		}
+		if opcode != gold.Opcode {
+			t.Errorf("%#x: got opcode %d, want %d", gold.Masked, opcode, gold.Opcode)
+		}
+		if got := string(buf[:n]); got != gold.Message {
+			t.Errorf("%#x: got %#x", gold.Masked, got)
+			t.Errorf("%#x: want %#x", gold.Masked, gold.Message)
+		}
+	}
+}
+
 var GoldenFragments = []struct {
 	Opcode   uint
 	Messages []string
@@ -209,7 +371,455 @@ func TestFragment(t *testing.T) {
 		}
 
 		wg.Wait()
+
+		if got, want := atomic.LoadUint64(&conn.readFrameN), uint64(len(gold.Maskeds)); got != want {
+			t.Errorf("%d: connection read %d frames, want %d", goldIndex, got, want)
+		}
+		if got, want := atomic.LoadUint64(&conn.writeFrameN), uint64(len(gold.Frames)); got != want {
+			t.Errorf("%d: connection wrote %d frames, want %d", goldIndex, got, want)
+		}
+	}
+}
+
+func TestReadModeConcurrent(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go io.Copy(testEnd, iotest.OneByteReader(strings.NewReader(GoldenFrames[3].Masked)))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var buf [16]byte
+		for {
+			_, err := conn.Read(buf[:])
+			if err != nil {
+				t.Error("read error:", err)
+				return
+			}
+			if _, final := conn.ReadMode(); final {
+				return
+			}
+		}
+	}()
+
+	// poll during reads (for the race detector)
+	for {
+		select {
+		case <-done:
+			if opcode, final := conn.ReadMode(); opcode != Continuation || !final {
+				t.Errorf("got opcode %d final %t after read, want %d final true", opcode, final, Continuation)
+			}
+			return
+		default:
+			conn.ReadMode()
+		}
+	}
+}
+
+func TestReservedBits(t *testing.T) {
+	// binary frame with RSV2 set and a zero mask
+	const frame = "\xa2\x83\x00\x00\x00\x00foo"
+
+	conn, testEnd := pipeConn()
+	conn.ReservedBits = 0x20
+	go io.WriteString(testEnd, frame)
+
+	var buf [8]byte
+	n, err := conn.Read(buf[:])
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if got := string(buf[:n]); got != "foo" {
+		t.Errorf("got payload %q, want \"foo\"", got)
+	}
+	if got := conn.ReadReserved(); got != 0x20 {
+		t.Errorf("got reserved bits %#x, want 0x20", got)
+	}
+
+	conn, testEnd = pipeConn()
+	conn.ReservedBits = 0x40
+	go io.WriteString(testEnd, frame)
+	go io.Copy(io.Discard, testEnd)
+
+	_, err = conn.Read(buf[:])
+	if err != ClosedError(ProtocolError) {
+		t.Errorf("got error %v, want %v", err, ClosedError(ProtocolError))
+	}
+}
+
+func TestCloseCause(t *testing.T) {
+	golden := []struct {
+		Frame string
+		Code  uint
+		Cause error
+	}{
+		{"\x82\x04food", ProtocolError, ErrNoMask},
+		{"\xc2\x80\x00\x00\x00\x00", ProtocolError, ErrReserved},
+		{"\x83\x80\x00\x00\x00\x00", ProtocolError, ErrOpcode},
+		{"\x8b\x80\x00\x00\x00\x00", ProtocolError, ErrOpcode},
+		{"\x09\x80\x00\x00\x00\x00", ProtocolError, ErrCtrlFragment},
+		{"\x89\xfe\x00\x7e\x00\x00\x00\x00", ProtocolError, ErrCtrlSize},
+		{"\x88\x84\x00\x00\x00\x00\x03\xe8\xff\xfe", Malformed, ErrCloseReason},
+	}
+	for _, gold := range golden {
+		conn, testEnd := pipeConn()
+		go io.WriteString(testEnd, gold.Frame)
+		go io.Copy(io.Discard, testEnd)
+
+		var buf [8]byte
+		_, err := conn.Read(buf[:])
+		if err != ClosedError(gold.Code) {
+			t.Errorf("%#x: got error %v, want %v", gold.Frame, err, ClosedError(gold.Code))
+		}
+		if got := conn.CloseCause(); got != gold.Cause {
+			t.Errorf("%#x: got close cause %v, want %v", gold.Frame, got, gold.Cause)
+		}
+	}
+
+	conn, testEnd := pipeConn()
+	conn.Accept = AcceptV13
+	go io.WriteString(testEnd, "\x83\x80\x00\x00\x00\x00")
+	go io.Copy(io.Discard, testEnd)
+	var buf [8]byte
+	if _, err := conn.Read(buf[:]); err != ClosedError(CannotAccept) {
+		t.Errorf("got error %v, want %v", err, ClosedError(CannotAccept))
+	}
+	if got := conn.CloseCause(); got != ErrOpcode {
+		t.Errorf("got close cause %v, want %v", got, ErrOpcode)
+	}
+
+	// reserved opcode with flag
+	conn, testEnd = pipeConn()
+	conn.Accept = AcceptV13 | 1<<Reserved3
+	go io.WriteString(testEnd, "\x83\x80\x00\x00\x00\x00")
+	if _, err := conn.Read(buf[:]); err != nil {
+		t.Error("read error on accepted reserved opcode:", err)
+	}
+	if opcode, _ := conn.ReadMode(); opcode != Reserved3 {
+		t.Errorf("got opcode %d, want %d", opcode, Reserved3)
+	}
+
+	conn, testEnd = pipeConn()
+	go io.Copy(io.Discard, testEnd)
+	conn.SendClose(NormalClose, "")
+	if got := conn.CloseCause(); got != nil {
+		t.Errorf("got close cause %v after SendClose, want nil", got)
+	}
+}
+
+func TestAcceptOpcodes(t *testing.T) {
+	if got := AcceptOpcodes(Continuation, Text, Binary, Close, Ping, Pong); got != AcceptV13 {
+		t.Errorf("got %#x, want AcceptV13 %#x", got, uint(AcceptV13))
+	}
+	if got := AcceptOpcodes(); got != 0 {
+		t.Errorf("got %#x without opcodes, want 0", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("opcode 16 got no panic")
+		}
+	}()
+	AcceptOpcodes(Text, 16)
+}
+
+func TestMaxControlPayload(t *testing.T) {
+	ping := "\x89\x84\x00\x00\x00\x00ping"
+
+	conn, testEnd := pipeConn()
+	conn.MaxControlPayload = 4
+	go io.WriteString(testEnd, ping+"\x82\x80\x00\x00\x00\x00")
+	go io.Copy(io.Discard, testEnd)
+	if _, _, err := conn.Receive(nil, time.Second, time.Second); err != nil {
+		t.Error("receive error with ping at limit:", err)
+	}
+
+	conn, testEnd = pipeConn()
+	conn.MaxControlPayload = 3
+	go io.WriteString(testEnd, ping)
+	go io.Copy(io.Discard, testEnd)
+	var buf [8]byte
+	if _, err := conn.Read(buf[:]); err != ClosedError(ProtocolError) {
+		t.Errorf("got error %v, want %v", err, ClosedError(ProtocolError))
+	}
+	if got := conn.CloseCause(); got != ErrCtrlSize {
+		t.Errorf("got close cause %v, want %v", got, ErrCtrlSize)
+	}
+}
+
+func TestTotalReadLimit(t *testing.T) {
+	conn, testEnd := pipeConn()
+	conn.TotalReadLimit = 20
+	go func() {
+		// one frame per write, with 16 bytes each
+		const frame = "\x82\x8a\x00\x00\x00\x000123456789"
+		for i := 0; i < 2; i++ {
+			if _, err := io.WriteString(testEnd, frame); err != nil {
+				t.Error("test end write error:", err)
+			}
+		}
+		io.Copy(io.Discard, testEnd)
+	}()
+
+	var buf [16]byte
+	if _, n, err := conn.Receive(buf[:], time.Second, time.Second); err != nil || n != 10 {
+		t.Fatalf("first receive got %d bytes with error %v, want 10 bytes", n, err)
+	}
+	_, _, err := conn.Receive(buf[:], time.Second, time.Second)
+	if err != ClosedError(Policy) {
+		t.Errorf("second receive got error %v, want %v", err, ClosedError(Policy))
+	}
+}
+
+func TestSizeOverflow(t *testing.T) {
+	// 64-bit maximum violates the specification
+	conn, testEnd := pipeConn()
+	go io.WriteString(testEnd, "\x82\xff\xff\xff\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00")
+	go io.Copy(io.Discard, testEnd)
+	var buf [8]byte
+	if _, err := conn.Read(buf[:]); err != ClosedError(TooBig) {
+		t.Errorf("got error %v, want %v", err, ClosedError(TooBig))
+	}
+
+	// 3 GiB wraps to negative on 32-bit platforms
+	conn, testEnd = pipeConn()
+	go io.WriteString(testEnd, "\x82\xff\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x00"+"payload…")
+	go io.Copy(io.Discard, testEnd)
+	_, n, err := conn.Receive(buf[:], time.Second, time.Second)
+	// frame rejection on 32-bit, and message rejection on 64-bit
+	if err != ErrOverflow && err != ClosedError(TooBig) {
+		t.Errorf("got error %v, want %v or %v", err, ErrOverflow, ClosedError(TooBig))
+	}
+	if got := conn.Stats().CloseCode; got != TooBig {
+		t.Errorf("got close code %d, want %d", got, TooBig)
+	}
+	if n > len(buf) || n < 0 {
+		t.Errorf("got %d bytes received, want in range [0, %d]", n, len(buf))
+	}
+}
+
+func TestDataAfterClose(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go func() {
+		// close frame followed by a text frame
+		io.WriteString(testEnd, "\x88\x82\x00\x00\x00\x00\x03\xe8"+"\x81\x83\x00\x00\x00\x00foo")
+		io.Copy(io.Discard, testEnd)
+	}()
+
+	var buf [8]byte
+	for i := 0; i < 2; i++ {
+		opcode, n, err := conn.Receive(buf[:], time.Second, time.Second)
+		if err != ClosedError(NormalClose) {
+			t.Errorf("receive %d got opcode %d with %q, error %v; want %v", i, opcode, buf[:n], err, ClosedError(NormalClose))
+		}
+	}
+}
+
+func TestCloseReply(t *testing.T) {
+	conn, testEnd := pipeConn()
+	var gotCode uint
+	var gotReason string
+	conn.CloseReply = func(statusCode uint, reason string) (uint, string) {
+		gotCode, gotReason = statusCode, reason
+		return NormalClose, "ok"
+	}
+	done := make(chan string)
+	go func() {
+		io.WriteString(testEnd, "\x88\x85\x00\x00\x00\x00\x03\xe9bye")
+		var got strings.Builder
+		io.Copy(&got, testEnd)
+		done <- got.String()
+	}()
+
+	var buf [8]byte
+	if _, _, err := conn.Receive(buf[:], time.Second, time.Second); err != ClosedError(GoingAway) {
+		t.Errorf("got error %v, want %v", err, ClosedError(GoingAway))
+	}
+	if gotCode != GoingAway || gotReason != "bye" {
+		t.Errorf("hook got status code %d with reason %q, want %d with \"bye\"", gotCode, gotReason, GoingAway)
+	}
+	conn.Close()
+	if got, want := <-done, "\x88\x04\x03\xe8ok"; got != want {
+		t.Errorf("got reply %q, want %q", got, want)
+	}
+}
+
+func TestRemoteCloseReason(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go func() {
+		io.WriteString(testEnd, "\x88\x85\x00\x00\x00\x00\x03\xe9bye")
+		io.Copy(io.Discard, testEnd)
+	}()
+	if got := conn.RemoteCloseReason(); got != "" {
+		t.Errorf("got reason %q before Close, want none", got)
 	}
+	var buf [8]byte
+	if _, _, err := conn.Receive(buf[:], time.Second, time.Second); err != ClosedError(GoingAway) {
+		t.Errorf("got error %v, want %v", err, ClosedError(GoingAway))
+	}
+	if got := conn.RemoteCloseReason(); got != "bye" {
+		t.Errorf("got reason %q, want \"bye\"", got)
+	}
+
+	// no reason from own Close
+	conn, testEnd = pipeConn()
+	go io.Copy(io.Discard, testEnd)
+	conn.SendClose(NormalClose, "done")
+	if got := conn.RemoteCloseReason(); got != "" {
+		t.Errorf("got reason %q after SendClose, want none", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	conn, testEnd := pipeConn()
+	conn.Accept = AcceptV13
+	go func() {
+		io.WriteString(testEnd, "\x82\x83\x00\x00\x00\x00foo")
+		io.Copy(io.Discard, testEnd)
+	}()
+	var buf [8]byte
+	if _, _, err := conn.Receive(buf[:], time.Second, time.Second); err != nil {
+		t.Fatal("receive error:", err)
+	}
+	conn.SendClose(Policy, "")
+	conn.Close()
+
+	testConn, testEnd := net.Pipe()
+	defer testConn.Close()
+	conn.Reset(testConn)
+	if got := conn.Stats(); got != (ConnStats{}) {
+		t.Errorf("got stats %+v after reset, want zero", got)
+	}
+	if conn.Accept != AcceptV13 {
+		t.Errorf("got Accept %#x after reset, want %#x", conn.Accept, AcceptV13)
+	}
+
+	go io.WriteString(testEnd, "\x81\x83\x00\x00\x00\x00bar")
+	opcode, n, err := conn.Receive(buf[:], time.Second, time.Second)
+	if err != nil || opcode != Text || string(buf[:n]) != "bar" {
+		t.Errorf("receive after reset got opcode %d, message %q, error %v", opcode, buf[:n], err)
+	}
+}
+
+func TestFrameTap(t *testing.T) {
+	conn, testEnd := pipeConn()
+	var tap bytes.Buffer
+	conn.FrameTap = &tap
+	const inbound = "\x81\x83\x01\x02\x03\x04" + "\x60\x67\x62" // "abc" masked
+	go func() {
+		io.WriteString(testEnd, inbound)
+		io.Copy(io.Discard, testEnd)
+	}()
+
+	var buf [8]byte
+	if _, _, err := conn.Receive(buf[:], time.Second, time.Second); err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if got := tap.String(); got != inbound {
+		t.Errorf("got tap %q after receive, want %q", got, inbound)
+	}
+
+	tap.Reset()
+	if err := conn.SendBuffers(Binary, net.Buffers{[]byte("d"), []byte("e")}, time.Second); err != nil {
+		t.Fatal("send error:", err)
+	}
+	if err := conn.Send(Text, []byte("f"), time.Second); err != nil {
+		t.Fatal("send error:", err)
+	}
+	if got, want := tap.String(), "\x82\x02de\x81\x01f"; got != want {
+		t.Errorf("got tap %q after send, want %q", got, want)
+	}
+}
+
+func TestHalfDuplex(t *testing.T) {
+	conn, testEnd := pipeConn()
+	conn.HalfDuplex = true
+	go io.Copy(io.Discard, testEnd)
+	var frameSent int64 // atomic
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt64(&frameSent, time.Now().UnixNano())
+		io.WriteString(testEnd, "\x82\x80\x00\x00\x00\x00")
+	}()
+
+	received := make(chan error)
+	go func() {
+		_, _, err := conn.Receive(nil, time.Second, time.Second)
+		received <- err
+	}()
+	// await pending read
+	time.Sleep(10 * time.Millisecond)
+	if err := conn.Send(Binary, nil, time.Second); err != nil {
+		t.Fatal("send error:", err)
+	}
+	if atomic.LoadInt64(&frameSent) == 0 {
+		t.Error("send completed while receive was pending")
+	}
+	if err := <-received; err != nil {
+		t.Error("receive error:", err)
+	}
+}
+
+func TestBufferedReadBytes(t *testing.T) {
+	testConn, testEnd := net.Pipe()
+	defer testConn.Close()
+	defer testEnd.Close()
+
+	conn := NewConn(testConn, []byte("\x82\x80\x00\x00\x00\x00"+"\x82\x81\x00\x00\x00\x00x"))
+	for _, want := range []int{13, 7, 0} {
+		if got := conn.BufferedReadBytes(); got != want {
+			t.Errorf("got %d buffered bytes, want %d", got, want)
+		}
+		if want == 0 {
+			break
+		}
+		var buf [8]byte
+		if _, _, err := conn.Receive(buf[:], time.Second, time.Second); err != nil {
+			t.Fatal("receive error:", err)
+		}
+	}
+}
+
+func TestNetConn(t *testing.T) {
+	testConn, testEnd := net.Pipe()
+	defer testConn.Close()
+	defer testEnd.Close()
+
+	if got := NewConn(testConn, nil).NetConn(); got != testConn {
+		t.Errorf("got %v, want the net.Conn from NewConn", got)
+	}
+	large := make([]byte, 1024)
+	if got := NewConn(testConn, large).NetConn(); got != testConn {
+		t.Errorf("got %v, want the net.Conn from NewConn with buffered data", got)
+	}
+}
+
+func TestSetWriteModeRange(t *testing.T) {
+	golden := []struct {
+		Opcode uint
+		Final  bool
+	}{
+		{16, true},
+		{16, false},
+		{Ping, false},
+		{Close, false},
+		{Reserved15, false},
+	}
+	for _, gold := range golden {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("opcode %d final %t did not panic", gold.Opcode, gold.Final)
+				}
+			}()
+			new(Conn).SetWriteMode(gold.Opcode, gold.Final)
+		}()
+	}
+
+	// valid cases
+	var c Conn
+	c.SetWriteMode(Continuation, true)
+	c.SetWriteMode(Binary, false)
+	c.SetWriteMode(Reserved15, true)
 }
 
 func TestConnInterface(t *testing.T) {
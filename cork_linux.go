@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package websocket
+
+import (
+	"net"
+	"syscall"
+)
+
+// SetCork applies TCP_CORK on TCP connections. Other transports are ignored.
+func setCork(conn net.Conn, on bool) {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	raw, err := tcp.SyscallConn()
+	if err != nil {
+		return
+	}
+	var v int
+	if on {
+		v = 1
+	}
+	raw.Control(func(fd uintptr) {
+		// best effort; errors leave the socket as is
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CORK, v)
+	})
+}
@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCorkStreams(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, c)
+	}()
+
+	conn := dialListener(t, ln)
+	defer conn.Close()
+	conn.CorkStreams = true
+
+	corked := func() int {
+		raw, err := conn.Conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v int
+		raw.Control(func(fd uintptr) {
+			v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CORK)
+		})
+		if err != nil {
+			t.Fatal("get TCP_CORK:", err)
+		}
+		return v
+	}
+
+	w := conn.SendStream(Binary, time.Second)
+	if got := corked(); got != 1 {
+		t.Errorf("got TCP_CORK %d during stream, want 1", got)
+	}
+	if _, err := w.Write([]byte("abc")); err != nil {
+		t.Fatal("stream write error:", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("stream close error:", err)
+	}
+	if got := corked(); got != 0 {
+		t.Errorf("got TCP_CORK %d after stream, want 0", got)
+	}
+}
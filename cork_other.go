@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package websocket
+
+import "net"
+
+// SetCork is not supported on this platform.
+func setCork(conn net.Conn, on bool) {}
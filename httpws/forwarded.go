@@ -0,0 +1,72 @@
+package httpws
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ForwardedHost returns the scheme and host of r, as requested by the client.
+// Reverse proxies convey the original values in request headers, either with
+// Forwarded, conform “Forwarded HTTP Extension” RFC 7239, or with the de facto
+// X-Forwarded-Proto and X-Forwarded-Host. Such headers are honored only when
+// trustProxy approves the remote address of r, i.e., r.RemoteAddr. A nil
+// trustProxy trusts nothing.
+//
+// Only the last entry of each header counts, as that one was set by the proxy
+// in front of the server. Any preceding entries can come from the client as is.
+// The scheme defaults to "https" when r has TLS, and to "http" otherwise. The
+// host defaults to r.Host.
+func ForwardedHost(r *http.Request, trustProxy func(remoteAddr string) bool) (scheme, host string) {
+	if r.TLS != nil {
+		scheme = "https"
+	} else {
+		scheme = "http"
+	}
+	host = r.Host
+
+	if trustProxy == nil || !trustProxy(r.RemoteAddr) {
+		return scheme, host
+	}
+
+	if header := headerList(r, "Forwarded"); header != "" {
+		element := lastListEntry(header)
+		for element != "" {
+			var pair string
+			if i := strings.IndexByte(element, ';'); i >= 0 {
+				pair, element = element[:i], element[i+1:]
+			} else {
+				pair, element = element, ""
+			}
+
+			i := strings.IndexByte(pair, '=')
+			if i < 0 {
+				continue
+			}
+			value := strings.Trim(strings.TrimSpace(pair[i+1:]), `"`)
+			if value == "" {
+				continue
+			}
+			switch strings.ToLower(strings.TrimSpace(pair[:i])) {
+			case "proto":
+				scheme = strings.ToLower(value)
+			case "host":
+				host = value
+			}
+		}
+		return scheme, host
+	}
+
+	if proto := lastListEntry(headerList(r, "X-Forwarded-Proto")); proto != "" {
+		scheme = strings.ToLower(proto)
+	}
+	if s := lastListEntry(headerList(r, "X-Forwarded-Host")); s != "" {
+		host = s
+	}
+	return scheme, host
+}
+
+// LastListEntry returns the last element from a comma-separated list, without
+// any surrounding white space.
+func lastListEntry(list string) string {
+	return strings.Trim(list[strings.LastIndexByte(list, ',')+1:], " \t")
+}
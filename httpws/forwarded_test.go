@@ -0,0 +1,70 @@
+package httpws
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestForwardedHost(t *testing.T) {
+	trustLocal := func(remoteAddr string) bool {
+		return remoteAddr == "127.0.0.1:1234"
+	}
+
+	golden := []struct {
+		RemoteAddr string
+		TLS        bool
+		Header     http.Header
+		Scheme     string
+		Host       string
+	}{
+		{"127.0.0.1:1234", false, http.Header{}, "http", "example.com"},
+		{"127.0.0.1:1234", true, http.Header{}, "https", "example.com"},
+		{"127.0.0.1:1234", false, http.Header{
+			"Forwarded": {`for=192.0.2.60;proto=HTTPS;host="example.net"`},
+		}, "https", "example.net"},
+		{"127.0.0.1:1234", false, http.Header{
+			"Forwarded": {"host=evil.example, proto=https;host=example.net"},
+		}, "https", "example.net"},
+		{"127.0.0.1:1234", false, http.Header{
+			"Forwarded": {"host=evil.example", "for=192.0.2.43"},
+		}, "http", "example.com"},
+		{"127.0.0.1:1234", false, http.Header{
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"evil.example, example.net"},
+		}, "https", "example.net"},
+		{"127.0.0.1:1234", false, http.Header{
+			"Forwarded":        {"host=example.net"},
+			"X-Forwarded-Host": {"example.org"},
+		}, "http", "example.net"},
+		// untrusted
+		{"192.0.2.1:1234", false, http.Header{
+			"Forwarded":         {"proto=https;host=example.net"},
+			"X-Forwarded-Proto": {"https"},
+			"X-Forwarded-Host":  {"example.net"},
+		}, "http", "example.com"},
+	}
+	for _, gold := range golden {
+		r := &http.Request{
+			Host:       "example.com",
+			RemoteAddr: gold.RemoteAddr,
+			Header:     gold.Header,
+		}
+		if gold.TLS {
+			r.TLS = new(tls.ConnectionState)
+		}
+
+		scheme, host := ForwardedHost(r, trustLocal)
+		if scheme != gold.Scheme || host != gold.Host {
+			t.Errorf("%s %v: got %q %q, want %q %q", gold.RemoteAddr, gold.Header, scheme, host, gold.Scheme, gold.Host)
+		}
+	}
+
+	r := &http.Request{
+		Host:   "example.com",
+		Header: http.Header{"Forwarded": {"host=example.net"}},
+	}
+	if _, host := ForwardedHost(r, nil); host != "example.com" {
+		t.Errorf("got host %q without trust, want \"example.com\"", host)
+	}
+}
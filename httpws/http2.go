@@ -0,0 +1,136 @@
+package httpws
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pascaldekloe/websocket"
+)
+
+// UpgradeHTTP2 bootstraps WebSocket on an HTTP/2 stream, conform “Bootstrapping
+// WebSockets with HTTP/2” RFC 8441. The request must be an extended CONNECT, as
+// in IsExtendedConnect. Use Upgrade for HTTP/1.1 instead. The HTTP server must
+// advertise SETTINGS_ENABLE_CONNECT_PROTOCOL, or clients won't send any such
+// request.
+//
+// The responseHeader is included in the response, like with Upgrade. Frames go
+// over the request body and the response body. The stream ends when the HTTP
+// handler returns, so the handler must hold on until the connection is done,
+// e.g., with Conn.WaitClose. Deadlines require a ResponseWriter with methods
+// SetReadDeadline and SetWriteDeadline, like the one from the standard library
+// since Go 1.20. The deadlines fail with an error otherwise, which disables the
+// timeouts of the high-level methods from Conn.
+func UpgradeHTTP2(w http.ResponseWriter, r *http.Request, responseHeader http.Header) (*websocket.Conn, error) {
+	if !IsExtendedConnect(r) {
+		http.Error(w, "This service requires an extended CONNECT for WebSocket.", http.StatusBadRequest)
+		return nil, ErrUpgrade
+	}
+	if !isVersion13(r) {
+		w.Header()["Sec-Websocket-Version"] = []string{"13"}
+		http.Error(w, "The Sec-WebSocket-Version header MUST include 13.", http.StatusBadRequest)
+		return nil, ErrUpgrade
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "The server is incompatible with the WebSocket implementation.", http.StatusInternalServerError)
+		return nil, errors.New("websocket: http.Flusher not implemented")
+	}
+
+	h := w.Header()
+	for name, values := range responseHeader {
+		h[name] = values
+	}
+	// no Sec-WebSocket-Accept with RFC 8441; any 2xx status establishes
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &websocket.Conn{Conn: &streamConn{
+		w:       w,
+		flusher: flusher,
+		body:    r.Body,
+		remote:  stringAddr(r.RemoteAddr),
+		local:   localAddr(r),
+	}}, nil
+}
+
+// StreamConn is a net.Conn on an HTTP/2 stream.
+type streamConn struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	body    io.ReadCloser
+	remote  net.Addr
+	local   net.Addr
+}
+
+// ErrNoDeadline rejects deadlines on a ResponseWriter without support.
+var errNoDeadline = errors.New("websocket: HTTP/2 stream without deadline support")
+
+// Read implements the net.Conn interface.
+func (c *streamConn) Read(p []byte) (n int, err error) {
+	return c.body.Read(p)
+}
+
+// Write implements the net.Conn interface.
+func (c *streamConn) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	if err == nil {
+		c.flusher.Flush()
+	}
+	return
+}
+
+// Close implements the net.Conn interface. The stream remains open until the
+// HTTP handler returns.
+func (c *streamConn) Close() error {
+	return c.body.Close()
+}
+
+// LocalAddr implements the net.Conn interface.
+func (c *streamConn) LocalAddr() net.Addr { return c.local }
+
+// RemoteAddr implements the net.Conn interface.
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+// SetDeadline implements the net.Conn interface.
+func (c *streamConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements the net.Conn interface.
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.w.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return errNoDeadline
+}
+
+// SetWriteDeadline implements the net.Conn interface.
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return errNoDeadline
+}
+
+// LocalAddr returns the server address from the request context, if any.
+func localAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return stringAddr("")
+}
+
+// StringAddr is a TCP address in its textual form.
+type stringAddr string
+
+// Network implements the net.Addr interface.
+func (a stringAddr) Network() string { return "tcp" }
+
+// String implements the net.Addr interface.
+func (a stringAddr) String() string { return string(a) }
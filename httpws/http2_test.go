@@ -0,0 +1,65 @@
+package httpws
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/websocket"
+)
+
+func TestUpgradeHTTP2(t *testing.T) {
+	body, clientEnd := io.Pipe()
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header: http.Header{
+			":protocol":             []string{"websocket"},
+			"Sec-Websocket-Version": []string{"13"},
+		},
+		Body:       body,
+		RemoteAddr: "192.0.2.1:1234",
+	}
+	w := httptest.NewRecorder()
+
+	conn, err := UpgradeHTTP2(w, r, http.Header{"Sec-Websocket-Protocol": []string{"chat"}})
+	if err != nil {
+		t.Fatal("upgrade error:", err)
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("got HTTP status code %d, want 200", w.Code)
+	}
+	if got := w.Header().Get("Sec-Websocket-Protocol"); got != "chat" {
+		t.Errorf("got Sec-WebSocket-Protocol %q, want \"chat\"", got)
+	}
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:1234" {
+		t.Errorf("got remote address %q, want 192.0.2.1:1234", got)
+	}
+
+	// masked text frame with zero mask
+	go io.WriteString(clientEnd, "\x81\x85\x00\x00\x00\x00Hello")
+	var buf [16]byte
+	opcode, n, err := conn.Receive(buf[:], time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if opcode != websocket.Text || string(buf[:n]) != "Hello" {
+		t.Errorf("got opcode %d with %q, want text \"Hello\"", opcode, buf[:n])
+	}
+
+	if err := conn.Send(websocket.Binary, []byte("abc"), time.Second); err != nil {
+		t.Fatal("send error:", err)
+	}
+	if got, want := w.Body.String(), "\x82\x03abc"; got != want {
+		t.Errorf("got response body %q, want %q", got, want)
+	}
+
+	// HTTP/1.1 requests keep on Upgrade
+	r.Proto, r.ProtoMajor = "HTTP/1.1", 1
+	if _, err := UpgradeHTTP2(httptest.NewRecorder(), r, nil); err != ErrUpgrade {
+		t.Errorf("HTTP/1.1 request got error %v, want %v", err, ErrUpgrade)
+	}
+}
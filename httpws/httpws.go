@@ -1,9 +1,11 @@
 package httpws
 
 import (
+	"bufio"
 	"crypto/sha1"
 	"encoding/base64"
 	"errors"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -17,6 +19,22 @@ func IsUpgradeRequest(r *http.Request) bool {
 	return isConnectionUpgrade(r) && isUpgradeWebSocket(r)
 }
 
+// IsExtendedConnect returns whether the client requested a WebSocket over HTTP/2
+// with an extended CONNECT, conform “Bootstrapping WebSockets with HTTP/2” RFC
+// 8441. Such requests need UpgradeHTTP2, as Upgrade fails with ErrHTTP2.
+func IsExtendedConnect(r *http.Request) bool {
+	if r.ProtoMajor < 2 || r.Method != http.MethodConnect {
+		return false
+	}
+	// pseudo-header, if any, as passed by the HTTP/2 server
+	for _, s := range r.Header[":protocol"] {
+		if strings.EqualFold(s, "websocket") {
+			return true
+		}
+	}
+	return false
+}
+
 func isConnectionUpgrade(r *http.Request) bool {
 	// “Connection options are case-insensitive.”
 	// — “HTTP/1.1 Message Syntax and Routing” RFC 7230, subsection 6.1
@@ -60,9 +78,29 @@ func isUpgradeWebSocket(r *http.Request) bool {
 	return false
 }
 
+func isVersion13(r *http.Request) bool {
+	header := headerList(r, "Sec-Websocket-Version")
+
+	var offset int
+	for i, c := range header {
+		switch c {
+		case ',', ' ', '\t':
+			if header[offset:i] == "13" {
+				return true
+			}
+
+			offset = i + 1
+		}
+	}
+
+	return header[offset:] == "13"
+}
+
 // Subprotocols returns the application-level options acceptable to the client.
 // The server propagates the selection with the Sec-WebSocket-Protocol response
-// header in the response.
+// header in the response. Entries which are not a valid token, conform “HTTP/1.1
+// Message Syntax and Routing” RFC 7230, subsection 3.2.6, are omitted. Thus, the
+// return is safe to echo in a response header.
 func Subprotocols(r *http.Request) []string {
 	header := headerList(r, "Sec-Websocket-Protocol")
 
@@ -72,20 +110,36 @@ func Subprotocols(r *http.Request) []string {
 	for i, c := range header {
 		switch c {
 		case ',', ' ', '\t':
-			if i > offset {
+			if i > offset && isToken(header[offset:i]) {
 				a = append(a, header[offset:i])
 			}
 			offset = i + 1
 		}
 	}
 
-	if len(header) > offset {
+	if len(header) > offset && isToken(header[offset:]) {
 		a = append(a, header[offset:])
 	}
 
 	return a
 }
 
+// IsToken returns whether s is a token conform “HTTP/1.1 Message Syntax and
+// Routing” RFC 7230, subsection 3.2.6.
+func isToken(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			break
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+			break
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func headerList(r *http.Request, name string) string {
 	// “Multiple message-header fields with the same field-name MAY be
 	// present in a message if and only if the entire field-value for that
@@ -100,51 +154,161 @@ func headerList(r *http.Request, name string) string {
 
 var keyGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
 
+// MaxChallengeKeyLen bounds the Sec-WebSocket-Key header. Valid keys have 24
+// bytes, i.e., a 16-byte nonce in base64 encoding. The margin allows for lenient
+// clients while it limits the hashing effort.
+const maxChallengeKeyLen = 256
+
 // ErrUpgrade means the HTTP request was rejected based on contstraints.
 var ErrUpgrade = errors.New("websocket: HTTP request rejected")
 
+// ErrUpgraded rejects a handshake on a connection which was hijacked already,
+// e.g., by a previous Upgrade. No response is written in such case.
+var ErrUpgraded = errors.New("websocket: HTTP connection hijacked already")
+
+// ErrHTTP2 rejects requests over HTTP/2 [or later]. The upgrade mechanism is
+// specific to HTTP/1.1, as HTTP/2 multiplexes its connections. Clients fall back
+// to HTTP/1.1 for WebSocket, unless the server advertises support for RFC 8441.
+// Servers which negotiate HTTP/2 for WebSocket endpoints need to disable it,
+// e.g., with a non-nil, empty TLSNextProto map on the http.Server, or they need
+// to serve WebSocket from a dedicated HTTP/1.1 listener. Extended CONNECT
+// requests may use UpgradeHTTP2 instead.
+var ErrHTTP2 = errors.New("websocket: HTTP/2 request can't upgrade; WebSocket requires HTTP/1.1")
+
 // Upgrade the HTTP server connection to the WebSocket protocol. The request
-// method must be GET.
+// method must be GET. Requests over HTTP/2 fail with ErrHTTP2, including
+// extended CONNECT requests, as in IsExtendedConnect.
 //
 // The responseHeader is included in the response to the client's upgrade
 // request. Use the responseHeader to specify cookies (Set-Cookie) and the
 // application negotiated subprotocol (Sec-WebSocket-Protocol).
+//
+// Clients may send their first frame(s) directly after the upgrade request,
+// without waiting for the response. Any such data, buffered by the HTTP server
+// already, is read by the connection before anything else.
 func Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header, timeout time.Duration) (*websocket.Conn, error) {
+	conn, rw, challengeKey, err := hijack(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	// read-ahead taken before the response; NewConn copies the bytes
+	buffered, _ := rw.Reader.Peek(rw.Reader.Buffered())
+
+	if err := respond(conn, rw, challengeKey, responseHeader, timeout); err != nil {
+		return nil, err
+	}
+	return websocket.NewConn(conn, buffered), nil
+}
+
+// Challenge is an authentication error for UpgradeAuth, with the value for the
+// WWW-Authenticate header, e.g., `Bearer realm="example"`.
+type Challenge string
+
+// Error implements the error interface.
+func (c Challenge) Error() string {
+	return "websocket: authentication required: " + string(c)
+}
+
+// UpgradeAuth is like Upgrade, with authenticate invoked on r first. A Challenge
+// error from authenticate is responded with HTTP 401 Unauthorized, including the
+// WWW-Authenticate header. Any other error is responded with HTTP 403 Forbidden.
+// The upgrade is aborted without hijack in both cases, and the error is returned
+// as is. Authentication must happen before the hijack, as the HTTP response is
+// unavailable afterwards.
+func UpgradeAuth(w http.ResponseWriter, r *http.Request, authenticate func(*http.Request) error, responseHeader http.Header, timeout time.Duration) (*websocket.Conn, error) {
+	if err := authenticate(r); err != nil {
+		if challenge, ok := err.(Challenge); ok {
+			// “The server generating a 401 response MUST send a
+			// WWW-Authenticate header field (Section 11.6.1) containing
+			// at least one challenge applicable to the target resource.”
+			// — “HTTP Semantics” RFC 9110, subsection 15.5.2
+			w.Header()["Www-Authenticate"] = []string{string(challenge)}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		} else {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+		return nil, err
+	}
+	return Upgrade(w, r, responseHeader, timeout)
+}
+
+// Handshake does the HTTP part of Upgrade only. The return is the hijacked
+// connection, as is, after the switching protocols response was sent. Any data
+// from the client, after the upgrade request, is pending in the bufio.Reader.
+func Handshake(w http.ResponseWriter, r *http.Request, responseHeader http.Header, timeout time.Duration) (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, challengeKey, err := hijack(w, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := respond(conn, rw, challengeKey, responseHeader, timeout); err != nil {
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// Hijack validates r, and it takes over the connection on success. The return
+// is the Sec-WebSocket-Key from r. Any rejection is responded to w.
+func hijack(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.ReadWriter, string, error) {
+	if r.ProtoMajor >= 2 {
+		// “HTTP/2 removes support for the 101 (Switching Protocols)
+		// informational status code”
+		// — “HTTP/2” RFC 9113, subsection 8.6
+		http.Error(w, "WebSocket requires HTTP/1.1.", http.StatusHTTPVersionNotSupported)
+		return nil, nil, "", ErrHTTP2
+	}
+
 	if !IsUpgradeRequest(r) {
 		h := w.Header()
 		h["Connection"] = []string{"Upgrade"}
 		h["Upgrade"] = []string{"websocket"}
 		http.Error(w, "This service requires use of the WebSocket protocol.", http.StatusUpgradeRequired)
-		return nil, ErrUpgrade
+		return nil, nil, "", ErrUpgrade
 	}
 
-	if headerList(r, "Sec-Websocket-Version") != "13" {
-		http.Error(w, "The Sec-WebSocket-Version header MUST be set to 13.", http.StatusBadRequest)
-		return nil, ErrUpgrade
+	if !isVersion13(r) {
+		// “the server MUST abort the WebSocket handshake described in
+		// this section and instead send an appropriate HTTP error code
+		// (such as 426 Upgrade Required) and a |Sec-WebSocket-Version|
+		// header field indicating the version(s) the server is capable
+		// of understanding.”
+		// — “The WebSocket Protocol” RFC 6455, subsection 4.4
+		w.Header()["Sec-Websocket-Version"] = []string{"13"}
+		http.Error(w, "The Sec-WebSocket-Version header MUST include 13.", http.StatusUpgradeRequired)
+		return nil, nil, "", ErrUpgrade
 	}
 
 	challengeKey := headerList(r, "Sec-Websocket-Key")
 	if challengeKey == "" {
 		http.Error(w, "The Sec-WebSocket-Key header MUST be set.", http.StatusBadRequest)
-		return nil, ErrUpgrade
+		return nil, nil, "", ErrUpgrade
+	}
+	if len(challengeKey) > maxChallengeKeyLen {
+		// key not echoed in the response
+		http.Error(w, "The Sec-WebSocket-Key header exceeds the size limit.", http.StatusBadRequest)
+		return nil, nil, "", ErrUpgrade
 	}
 
 	h, ok := w.(http.Hijacker)
 	if !ok {
 		http.Error(w, "The server is incompatible with the WebSocket implementation.", http.StatusInternalServerError)
-		return nil, errors.New("websocket: http.Hijacker not implemented")
+		return nil, nil, "", errors.New("websocket: http.Hijacker not implemented")
 	}
 	conn, rw, err := h.Hijack()
 	if err != nil {
+		if errors.Is(err, http.ErrHijacked) {
+			// response writer unusable
+			return nil, nil, "", ErrUpgraded
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return nil, err
-	}
-
-	if rw.Reader.Buffered() > 0 {
-		conn.Close()
-		return nil, errors.New("websocket: data before handshake")
+		return nil, nil, "", err
 	}
+	return conn, rw, challengeKey, nil
+}
 
+// Respond writes the switching protocols response. The connection is closed on
+// error.
+func respond(conn net.Conn, rw *bufio.ReadWriter, challengeKey string, responseHeader http.Header, timeout time.Duration) error {
 	conn.SetDeadline(time.Time{})
 	conn.SetWriteDeadline(time.Now().Add(timeout))
 
@@ -163,18 +327,17 @@ func Upgrade(w http.ResponseWriter, r *http.Request, responseHeader http.Header,
 	rw.WriteString("\r\n")
 
 	if len(responseHeader) != 0 {
-		if err = responseHeader.Write(rw); err != nil {
+		if err := responseHeader.Write(rw); err != nil {
 			conn.Close()
-			return nil, err
+			return err
 		}
 	}
 	// terminate header & response (with double CRLF)
 	rw.WriteString("\r\n")
 
-	if err = rw.Flush(); err != nil {
+	if err := rw.Flush(); err != nil {
 		conn.Close()
-		return nil, err
+		return err
 	}
-
-	return &websocket.Conn{Conn: conn}, nil
+	return nil
 }
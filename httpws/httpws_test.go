@@ -2,11 +2,16 @@ package httpws
 
 import (
 	"bufio"
+	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/pascaldekloe/websocket"
 )
 
 // deal with sloppy specification variations
@@ -121,13 +126,44 @@ func TestSubprotocols(t *testing.T) {
 	}
 }
 
+func TestSubprotocolsInvalidTokens(t *testing.T) {
+	r := &http.Request{Header: http.Header{
+		"Sec-Websocket-Protocol": []string{
+			"chat, a\r\nSet-Cookie:x, v2.chat, b\x00, \"quoted\", c/d, e=f, g\u00e9, ~ok",
+		},
+	}}
+	want := []string{"chat", "v2.chat", "~ok"}
+	got := Subprotocols(r)
+	if len(got) != len(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %q, want %q", got, want)
+			break
+		}
+	}
+}
+
 type HijackRecorder struct {
 	httptest.ResponseRecorder
-	Conn net.Conn
+	Conn     net.Conn
+	hijacked bool
+	// data read ahead by the HTTP server
+	Buffered string
 }
 
 func (r *HijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return r.Conn, bufio.NewReadWriter(bufio.NewReader(r.Conn), bufio.NewWriter(r.Conn)), nil
+	// like net/http does
+	if r.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	r.hijacked = true
+	reader := bufio.NewReader(io.MultiReader(strings.NewReader(r.Buffered), r.Conn))
+	if r.Buffered != "" {
+		reader.Peek(len(r.Buffered))
+	}
+	return r.Conn, bufio.NewReadWriter(reader, bufio.NewWriter(r.Conn)), nil
 }
 
 func TestUpgrade(t *testing.T) {
@@ -161,7 +197,7 @@ func TestUpgrade(t *testing.T) {
 		}
 	}()
 
-	var w http.ResponseWriter = &HijackRecorder{*httptest.NewRecorder(), testConn}
+	var w http.ResponseWriter = &HijackRecorder{ResponseRecorder: *httptest.NewRecorder(), Conn: testConn}
 
 	c, err := Upgrade(w, req, nil, time.Second)
 	if err != nil {
@@ -174,3 +210,286 @@ func TestUpgrade(t *testing.T) {
 		t.Error("connection close error:", err)
 	}
 }
+
+func TestUpgradePipelined(t *testing.T) {
+	req := &http.Request{
+		Header: http.Header{
+			"Upgrade":               []string{"websocket"},
+			"Connection":            []string{"Upgrade"},
+			"Sec-Websocket-Key":     []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+			"Sec-Websocket-Version": []string{"13"},
+		},
+	}
+
+	testConn, testEnd := net.Pipe()
+	// timeout protection (against hanging tests)
+	time.AfterFunc(2*time.Second, func() { testEnd.Close() })
+	go func() {
+		resp, err := http.ReadResponse(bufio.NewReader(testEnd), nil)
+		if err != nil {
+			t.Error("test end read error:", err)
+		} else if resp.StatusCode != 101 {
+			t.Errorf("got HTTP status code %d, want 101", resp.StatusCode)
+		}
+		io.Copy(io.Discard, testEnd)
+	}()
+
+	// first frame with the upgrade request
+	w := &HijackRecorder{
+		ResponseRecorder: *httptest.NewRecorder(),
+		Conn:             testConn,
+		Buffered:         "\x82\x83\x00\x00\x00\x00abc",
+	}
+	c, err := Upgrade(w, req, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var buf [8]byte
+	opcode, n, err := c.Receive(buf[:], time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if opcode != websocket.Binary || string(buf[:n]) != "abc" {
+		t.Errorf("got opcode %d with %q, want binary with \"abc\"", opcode, buf[:n])
+	}
+}
+
+func TestUpgradePipelinedResponseError(t *testing.T) {
+	req := &http.Request{
+		Header: http.Header{
+			"Upgrade":               []string{"websocket"},
+			"Connection":            []string{"Upgrade"},
+			"Sec-Websocket-Key":     []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+			"Sec-Websocket-Version": []string{"13"},
+		},
+	}
+
+	testConn, testEnd := net.Pipe()
+	testEnd.Close()
+
+	w := &HijackRecorder{
+		ResponseRecorder: *httptest.NewRecorder(),
+		Conn:             testConn,
+		Buffered:         "\x82\x83\x00\x00\x00\x00abc",
+	}
+	c, err := Upgrade(w, req, nil, time.Second)
+	if err == nil {
+		c.Close()
+		t.Fatal("upgrade with a broken connection got no error")
+	}
+	if c != nil {
+		t.Error("got a connection on error")
+	}
+}
+
+func TestUpgradeAuth(t *testing.T) {
+	req := &http.Request{
+		Header: http.Header{
+			"Upgrade":               []string{"websocket"},
+			"Connection":            []string{"Upgrade"},
+			"Sec-Websocket-Key":     []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+			"Sec-Websocket-Version": []string{"13"},
+		},
+	}
+	errDenied := errors.New("test denied")
+
+	w := &HijackRecorder{ResponseRecorder: *httptest.NewRecorder()}
+	_, err := UpgradeAuth(w, req, func(r *http.Request) error {
+		return errDenied
+	}, nil, time.Second)
+	if err != errDenied {
+		t.Errorf("got error %v, want %v", err, errDenied)
+	}
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got HTTP status code %d, want 403", w.Code)
+	}
+	if w.hijacked {
+		t.Error("connection hijacked on authentication error")
+	}
+
+	w = &HijackRecorder{ResponseRecorder: *httptest.NewRecorder()}
+	challenge := Challenge(`Bearer realm="test"`)
+	_, err = UpgradeAuth(w, req, func(r *http.Request) error {
+		return challenge
+	}, nil, time.Second)
+	if err != challenge {
+		t.Errorf("got error %v, want %v", err, challenge)
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got HTTP status code %d, want 401", w.Code)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != string(challenge) {
+		t.Errorf("got WWW-Authenticate %q, want %q", got, challenge)
+	}
+	if w.hijacked {
+		t.Error("connection hijacked on authentication challenge")
+	}
+
+	testConn, testEnd := net.Pipe()
+	// timeout protection (against hanging tests)
+	time.AfterFunc(2*time.Second, func() { testEnd.Close() })
+	go io.Copy(io.Discard, testEnd)
+
+	w = &HijackRecorder{ResponseRecorder: *httptest.NewRecorder(), Conn: testConn}
+	c, err := UpgradeAuth(w, req, func(r *http.Request) error {
+		return nil
+	}, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestHandshake(t *testing.T) {
+	req := &http.Request{
+		Header: http.Header{
+			"Upgrade":               []string{"websocket"},
+			"Connection":            []string{"Upgrade"},
+			"Sec-Websocket-Key":     []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+			"Sec-Websocket-Version": []string{"13"},
+		},
+	}
+
+	testConn, testEnd := net.Pipe()
+	// timeout protection (against hanging tests)
+	time.AfterFunc(2*time.Second, func() { testEnd.Close() })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		resp, err := http.ReadResponse(bufio.NewReader(testEnd), nil)
+		if err != nil {
+			t.Error("test end read error:", err)
+			return
+		}
+		// sample from “The WebSocket Protocol” RFC 6455, subsection 1.3
+		const want = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+		if got := resp.Header.Get("Sec-WebSocket-Accept"); got != want {
+			t.Errorf("got Sec-WebSocket-Accept %q, want %q", got, want)
+		}
+	}()
+
+	var w http.ResponseWriter = &HijackRecorder{ResponseRecorder: *httptest.NewRecorder(), Conn: testConn}
+
+	conn, rw, err := Handshake(w, req, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if conn != testConn {
+		t.Error("got a connection other than the hijacked one")
+	}
+	if n := rw.Reader.Buffered(); n != 0 {
+		t.Errorf("got %d bytes buffered", n)
+	}
+
+	// second handshake on the same connection
+	_, _, err = Handshake(w, req, nil, time.Second)
+	if err != ErrUpgraded {
+		t.Errorf("second handshake got error %v, want %v", err, ErrUpgraded)
+	}
+	if _, err := Upgrade(w, req, nil, time.Second); err != ErrUpgraded {
+		t.Errorf("upgrade after handshake got error %v, want %v", err, ErrUpgraded)
+	}
+	conn.Close()
+}
+
+func TestChallengeKeyLimit(t *testing.T) {
+	key := strings.Repeat("A", maxChallengeKeyLen+1)
+	r := &http.Request{Header: http.Header{
+		"Upgrade":               []string{"websocket"},
+		"Connection":            []string{"Upgrade"},
+		"Sec-Websocket-Key":     []string{key},
+		"Sec-Websocket-Version": []string{"13"},
+	}}
+	w := httptest.NewRecorder()
+	if _, err := Upgrade(w, r, nil, time.Second); err != ErrUpgrade {
+		t.Errorf("got error %v, want ErrUpgrade", err)
+	}
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got HTTP status code %d, want 400", w.Code)
+	}
+	if strings.Contains(w.Body.String(), key) {
+		t.Error("response echoes the challenge key")
+	}
+}
+
+func TestVersionNegotiation(t *testing.T) {
+	golden := []struct {
+		Header []string
+		Want   bool
+	}{
+		{nil, false},
+		{[]string{""}, false},
+		{[]string{"13"}, true},
+		{[]string{"8"}, false},
+		{[]string{"13, 8"}, true},
+		{[]string{"8, 13"}, true},
+		{[]string{"8,13"}, true},
+		{[]string{"8", "13"}, true},
+		{[]string{"7, 8"}, false},
+		{[]string{"130"}, false},
+		{[]string{"113"}, false},
+	}
+
+	for _, gold := range golden {
+		r := &http.Request{Header: make(http.Header)}
+		r.Header["Sec-Websocket-Version"] = gold.Header
+		if got := isVersion13(r); got != gold.Want {
+			t.Errorf("Sec-WebSocket-Version %q got %t, want %t", gold.Header, got, gold.Want)
+		}
+	}
+
+	// rejection advertises supported version
+	r := &http.Request{Header: http.Header{
+		"Upgrade":               []string{"websocket"},
+		"Connection":            []string{"Upgrade"},
+		"Sec-Websocket-Key":     []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+		"Sec-Websocket-Version": []string{"7, 8"},
+	}}
+	w := httptest.NewRecorder()
+	if _, err := Upgrade(w, r, nil, time.Second); err != ErrUpgrade {
+		t.Errorf("got error %v, want ErrUpgrade", err)
+	}
+	if w.Code != http.StatusUpgradeRequired {
+		t.Errorf("got HTTP status code %d, want 426", w.Code)
+	}
+	if got := w.Header().Get("Sec-WebSocket-Version"); got != "13" {
+		t.Errorf("got Sec-WebSocket-Version %q in response, want \"13\"", got)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	r := &http.Request{
+		Method:     http.MethodConnect,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header: http.Header{
+			":protocol":             []string{"websocket"},
+			"Sec-Websocket-Version": []string{"13"},
+		},
+	}
+	if !IsExtendedConnect(r) {
+		t.Error("extended CONNECT not recognized")
+	}
+	w := &HijackRecorder{ResponseRecorder: *httptest.NewRecorder()}
+	if _, err := Upgrade(w, r, nil, time.Second); err != ErrHTTP2 {
+		t.Errorf("got error %v, want %v", err, ErrHTTP2)
+	}
+	if w.Code != http.StatusHTTPVersionNotSupported {
+		t.Errorf("got HTTP status code %d, want 505", w.Code)
+	}
+	if w.hijacked {
+		t.Error("HTTP/2 request hijacked")
+	}
+
+	// HTTP/1.1 has no pseudo-headers
+	r.Proto, r.ProtoMajor = "HTTP/1.1", 1
+	if IsExtendedConnect(r) {
+		t.Error("HTTP/1.1 CONNECT recognized as extended CONNECT")
+	}
+}
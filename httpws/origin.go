@@ -44,7 +44,14 @@ func parseOrigin(s string) (o *Origin, ok bool) {
 		o.Port = port
 	} else {
 		o.Host = authority
-		o.Port, _ = net.LookupPort("tcp", o.Scheme)
+		switch o.Scheme {
+		case "http", "ws":
+			o.Port = 80
+		case "https", "wss":
+			o.Port = 443
+		default:
+			o.Port, _ = net.LookupPort("tcp", o.Scheme)
+		}
 	}
 	if o.Host == "" {
 		return nil, false
@@ -100,3 +107,19 @@ func AllowOrigin(r *http.Request, check func(serial string, o *Origin) (pass boo
 	}
 	return allow || check(s, origin)
 }
+
+// AllowOriginExact returns a check for AllowOrigin which passes the serialized
+// origins given, as is. No normalization is applied, so a default port must
+// match the serialization from the client. Browsers omit default ports, e.g.,
+// "https://example.com" passes with "https://example.com" only, and not with
+// "https://example.com:443". Use "null" to pass opaque origins.
+func AllowOriginExact(origins ...string) func(serial string, o *Origin) (pass bool) {
+	set := make(map[string]struct{}, len(origins))
+	for _, s := range origins {
+		set[s] = struct{}{}
+	}
+	return func(serial string, _ *Origin) bool {
+		_, ok := set[serial]
+		return ok
+	}
+}
@@ -19,6 +19,11 @@ var GoldenOrigins = []struct {
 		{"http", "[::1]", 8080},
 		{"http", "[::1]", 80},
 	}},
+	{"ws://example.com wss://example.com", []*Origin{
+		{"wss", "example.com", 443},
+		{"ws", "example.com", 80},
+	}},
+	{"wss://example.com:8443", []*Origin{{"wss", "example.com", 8443}}},
 	{"null", []*Origin{nil}},
 	{"file:/home", nil},
 	{"https://", nil},
@@ -94,3 +99,32 @@ func TestAllowOrigin(t *testing.T) {
 		}
 	}
 }
+
+func TestAllowOriginExact(t *testing.T) {
+	check := AllowOriginExact("https://example.com", "https://app.example.com:8443")
+
+	golden := []struct {
+		Header string
+		Want   bool
+	}{
+		{"https://example.com", true},
+		{"https://app.example.com:8443", true},
+		{"http://example.net https://example.com", true},
+		// default port explicit
+		{"https://example.com:443", false},
+		// explicit port omitted
+		{"https://app.example.com", false},
+		{"http://example.com", false},
+		{"https://EXAMPLE.com", false},
+		{"null", false},
+	}
+	for _, gold := range golden {
+		r := new(http.Request)
+		r.Header = make(http.Header)
+		r.Header.Set("Origin", gold.Header)
+
+		if got := AllowOrigin(r, check, false); got != gold.Want {
+			t.Errorf("%q got %t, want %t", gold.Header, got, gold.Want)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Package jsonrpc implements “JSON-RPC 2.0” over WebSocket Text messages.
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pascaldekloe/websocket"
+)
+
+// Error codes from the specification.
+const (
+	ParseError     = -32700
+	InvalidRequest = -32600
+	MethodNotFound = -32601
+	InvalidParams  = -32602
+	InternalError  = -32603
+)
+
+// Error is a JSON-RPC error object.
+type Error struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// Error honors the error interface.
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc: error code %d: %s", e.Code, e.Message)
+}
+
+// ErrClosed rejects calls after Serve returned.
+var ErrClosed = errors.New("jsonrpc: connection served no more")
+
+// HandlerFunc serves a method. The result is encoded with package encoding/json.
+// Errors other than *Error are passed as an InternalError. The result of a
+// notification is discarded.
+type HandlerFunc func(params json.RawMessage) (result interface{}, err error)
+
+// Message is the JSON structure of requests, notifications and responses.
+type message struct {
+	Version string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  json.RawMessage  `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+}
+
+// Conn exchanges requests and responses in both directions. Serve must run for
+// calls to get their response. Multiple goroutines may invoke methods on Conn
+// simultaneously.
+type Conn struct {
+	ws *websocket.Conn
+
+	// WireTimeout limits the transmission time of each message.
+	WireTimeout time.Duration
+	// IdleTimeout limits the amount of time to wait for a message in Serve.
+	IdleTimeout time.Duration
+	// MaxMessage limits the size of messages received in Serve. Messages
+	// which exceed the limit close the connection with status code 1009—
+	// TooBig.
+	MaxMessage int
+	// MaxConcurrent limits the number of requests and notifications served
+	// simultaneously. Serve stops receiving while the limit is reached. The
+	// zero value serves them one at a time, in order of arrival.
+	MaxConcurrent int
+
+	mutex    sync.Mutex
+	lastID   uint64
+	pending  map[uint64]chan *message
+	handlers map[string]HandlerFunc
+	err      error // set once Serve returns
+}
+
+// NewConn returns a new JSON-RPC layer on ws, with a default wire timeout of
+// one second, an idle timeout of one minute, a message limit of one MiB, and a
+// limit of 64 requests served simultaneously.
+func NewConn(ws *websocket.Conn) *Conn {
+	return &Conn{
+		ws:            ws,
+		WireTimeout:   time.Second,
+		IdleTimeout:   time.Minute,
+		MaxMessage:    1 << 20,
+		MaxConcurrent: 64,
+		pending:       make(map[uint64]chan *message),
+		handlers:      make(map[string]HandlerFunc),
+	}
+}
+
+// Handle installs h for requests and notifications on method. A nil h removes
+// any previous installation.
+func (c *Conn) Handle(method string, h HandlerFunc) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if h == nil {
+		delete(c.handlers, method)
+	} else {
+		c.handlers[method] = h
+	}
+}
+
+// Call sends a request and waits for its response, which is decoded into result
+// unless result is nil. Errors from the peer come as *Error.
+func (c *Conn) Call(ctx context.Context, method string, params, result interface{}) error {
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return c.err
+	}
+	c.lastID++
+	id := c.lastID
+	ch := make(chan *message, 1)
+	c.pending[id] = ch
+	c.mutex.Unlock()
+
+	rawID := json.RawMessage(strconv.FormatUint(id, 10))
+	err := c.send(&message{ID: &rawID, Method: method}, params)
+	if err != nil {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return ctx.Err()
+	case resp, ok := <-ch:
+		if !ok {
+			c.mutex.Lock()
+			err := c.err
+			c.mutex.Unlock()
+			return err
+		}
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(resp.Result, result)
+	}
+}
+
+// Notify sends a request without response.
+func (c *Conn) Notify(method string, params interface{}) error {
+	return c.send(&message{Method: method}, params)
+}
+
+// Send encodes params into m, and it sends m as a Text message.
+func (c *Conn) send(m *message, params interface{}) error {
+	if params != nil {
+		bytes, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		m.Params = bytes
+	}
+	m.Version = "2.0"
+	bytes, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.ws.Send(websocket.Text, bytes, c.WireTimeout)
+}
+
+// Serve receives messages until the connection fails. Responses are passed to
+// their respective Call. Requests and notifications go to the installed
+// handlers, each in their own routine, up to MaxConcurrent. Binary messages are
+// discarded. Batch requests are not supported, and they are responded with an
+// InvalidRequest error. The return is never nil. Pending calls fail with
+// ErrClosed.
+func (c *Conn) Serve() error {
+	err := c.serve()
+
+	c.mutex.Lock()
+	c.err = ErrClosed
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.mutex.Unlock()
+
+	return err
+}
+
+func (c *Conn) serve() error {
+	// reused; json.RawMessage fields copy on decode
+	var buf bytes.Buffer
+	// limits routines conform MaxConcurrent
+	var sem chan struct{}
+	for {
+		buf.Reset()
+		opcode, err := c.ws.ReceiveBuffer(&buf, c.MaxMessage, c.WireTimeout, c.IdleTimeout)
+		if err != nil {
+			return err
+		}
+		if opcode != websocket.Text {
+			continue
+		}
+
+		m := new(message)
+		if err := json.Unmarshal(buf.Bytes(), m); err != nil || m.Version != "2.0" {
+			code, text := InvalidRequest, "Invalid Request"
+			// valid JSON of another structure, e.g., a batch, is no
+			// parse error
+			var typeErr *json.UnmarshalTypeError
+			if err != nil && !errors.As(err, &typeErr) {
+				code, text = ParseError, "Parse error"
+			}
+			null := json.RawMessage("null")
+			err = c.send(&message{ID: &null, Error: &Error{Code: code, Message: text}}, nil)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch {
+		case m.Method == "":
+			c.gotResponse(m)
+		case c.MaxConcurrent <= 0:
+			c.gotRequest(m)
+		default:
+			if sem == nil {
+				sem = make(chan struct{}, c.MaxConcurrent)
+			}
+			sem <- struct{}{}
+			go func() {
+				defer func() { <-sem }()
+				c.gotRequest(m)
+			}()
+		}
+	}
+}
+
+func (c *Conn) gotResponse(m *message) {
+	if m.ID == nil {
+		return
+	}
+	id, err := strconv.ParseUint(string(*m.ID), 10, 64)
+	if err != nil {
+		return // not from Call
+	}
+
+	c.mutex.Lock()
+	ch, ok := c.pending[id]
+	delete(c.pending, id)
+	c.mutex.Unlock()
+
+	if ok {
+		ch <- m
+	}
+}
+
+func (c *Conn) gotRequest(m *message) {
+	c.mutex.Lock()
+	h := c.handlers[m.Method]
+	c.mutex.Unlock()
+
+	resp := message{ID: m.ID}
+	if h == nil {
+		resp.Error = &Error{Code: MethodNotFound, Message: "Method not found"}
+	} else {
+		result, err := h(m.Params)
+		if err != nil {
+			e, ok := err.(*Error)
+			if !ok {
+				e = &Error{Code: InternalError, Message: err.Error()}
+			}
+			resp.Error = e
+		} else if resp.Result, err = json.Marshal(result); err != nil {
+			resp.Error = &Error{Code: InternalError, Message: err.Error()}
+		}
+	}
+
+	if m.ID == nil {
+		return // notification
+	}
+	c.send(&resp, nil)
+}
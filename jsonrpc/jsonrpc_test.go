@@ -0,0 +1,187 @@
+package jsonrpc
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/websocket"
+)
+
+// TestEnd exchanges frames with a Conn.
+type testEnd struct {
+	t    *testing.T
+	conn net.Conn
+	r    *websocket.Reader
+}
+
+func newTestConn(t *testing.T) (*Conn, *testEnd) {
+	wsConn, end := net.Pipe()
+	// timeout protection (against hanging tests)
+	time.AfterFunc(2*time.Second, func() { wsConn.Close() })
+
+	return NewConn(&websocket.Conn{Conn: wsConn}), &testEnd{t, end, websocket.NewReader(make([]byte, 4096))}
+}
+
+// Send writes a Text message with a zero mask.
+func (end *testEnd) send(s string) {
+	frame := append([]byte{0x81, 0xfe, byte(len(s) >> 8), byte(len(s)), 0, 0, 0, 0}, s...)
+	if _, err := end.conn.Write(frame); err != nil {
+		end.t.Error("test end write error:", err)
+	}
+}
+
+// Receive reads a message, unfragmented.
+func (end *testEnd) receive() *message {
+	for {
+		payload, err := end.r.NextFrame()
+		if err == websocket.ErrUnderflow {
+			if err := end.r.ReadSome(end.conn); err != nil {
+				end.t.Fatal("test end read error:", err)
+			}
+			continue
+		}
+		if err != nil {
+			end.t.Fatal("test end frame error:", err)
+		}
+		m := new(message)
+		if err := json.Unmarshal(payload, m); err != nil {
+			end.t.Fatalf("test end got %q: %s", payload, err)
+		}
+		return m
+	}
+}
+
+func TestCall(t *testing.T) {
+	conn, end := newTestConn(t)
+	go conn.Serve()
+
+	go func() {
+		req := end.receive()
+		if req.Method != "add" || string(req.Params) != "[1,2]" {
+			t.Errorf("got method %q with params %s, want add with [1,2]", req.Method, req.Params)
+		}
+		end.send(`{"jsonrpc":"2.0","id":` + string(*req.ID) + `,"result":3}`)
+
+		req = end.receive()
+		end.send(`{"jsonrpc":"2.0","id":` + string(*req.ID) + `,"error":{"code":-32601,"message":"Method not found"}}`)
+	}()
+
+	var sum int
+	if err := conn.Call(context.Background(), "add", []int{1, 2}, &sum); err != nil {
+		t.Fatal("call error:", err)
+	}
+	if sum != 3 {
+		t.Errorf("got result %d, want 3", sum)
+	}
+
+	err := conn.Call(context.Background(), "nope", nil, nil)
+	if e, ok := err.(*Error); !ok || e.Code != MethodNotFound {
+		t.Errorf("got error %v, want code %d", err, MethodNotFound)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	conn, end := newTestConn(t)
+	notified := make(chan json.RawMessage, 1)
+	conn.Handle("echo", func(params json.RawMessage) (interface{}, error) {
+		return params, nil
+	})
+	conn.Handle("note", func(params json.RawMessage) (interface{}, error) {
+		notified <- params
+		return nil, nil
+	})
+	go conn.Serve()
+
+	end.send(`{"jsonrpc":"2.0","id":"a","method":"echo","params":["x"]}`)
+	resp := end.receive()
+	if string(*resp.ID) != `"a"` || string(resp.Result) != `["x"]` || resp.Error != nil {
+		t.Errorf("got id %s, result %s, error %v; want \"a\", [\"x\"], nil", *resp.ID, resp.Result, resp.Error)
+	}
+
+	end.send(`{"jsonrpc":"2.0","method":"note","params":{"k":1}}`)
+	select {
+	case params := <-notified:
+		if string(params) != `{"k":1}` {
+			t.Errorf("notification got params %s, want {\"k\":1}", params)
+		}
+	case <-time.After(time.Second):
+		t.Error("notification timeout")
+	}
+
+	end.send(`{"jsonrpc":"2.0","id":2,"method":"nope"}`)
+	if resp := end.receive(); resp.Error == nil || resp.Error.Code != MethodNotFound {
+		t.Errorf("got error %v, want code %d", resp.Error, MethodNotFound)
+	}
+
+	end.send(`[{"jsonrpc":"2.0","id":3,"method":"echo"}]`)
+	if resp := end.receive(); resp.Error == nil || resp.Error.Code != InvalidRequest {
+		t.Errorf("batch got error %v, want code %d", resp.Error, InvalidRequest)
+	}
+
+	end.send(`{broken`)
+	// null decodes as a nil ID
+	if resp := end.receive(); resp.Error == nil || resp.Error.Code != ParseError || resp.ID != nil {
+		t.Errorf("got error %v with id %v, want code %d with id null", resp.Error, resp.ID, ParseError)
+	}
+}
+
+func TestMaxMessage(t *testing.T) {
+	conn, end := newTestConn(t)
+	conn.MaxMessage = 16
+	go func() {
+		// drain Call and Close
+		buf := make([]byte, 4096)
+		for {
+			if _, err := end.conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	served := make(chan error, 1)
+	go func() { served <- conn.Serve() }()
+	called := make(chan error, 1)
+	go func() { called <- conn.Call(context.Background(), "wait", nil, nil) }()
+	time.Sleep(10 * time.Millisecond)
+
+	end.send(`{"jsonrpc":"2.0","method":"too long"}`)
+	if err := <-served; err != websocket.ErrOverflow {
+		t.Errorf("serve got error %v, want %v", err, websocket.ErrOverflow)
+	}
+	if err := <-called; err != ErrClosed {
+		t.Errorf("pending call got error %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	conn, end := newTestConn(t)
+	conn.MaxConcurrent = 1
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	conn.Handle("block", func(params json.RawMessage) (interface{}, error) {
+		started <- string(params)
+		<-release
+		return nil, nil
+	})
+	go conn.Serve()
+
+	go end.send(`{"jsonrpc":"2.0","method":"block","params":1}`)
+	go end.send(`{"jsonrpc":"2.0","method":"block","params":2}`)
+	<-started
+	select {
+	case params := <-started:
+		t.Errorf("request with params %s served beyond limit", params)
+	case <-time.After(20 * time.Millisecond):
+		break
+	}
+	close(release)
+	select {
+	case <-started:
+		break
+	case <-time.After(time.Second):
+		t.Error("second request not served after release")
+	}
+}
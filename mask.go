@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// Payloads from this size on get the unrolled loop.
+const maskUnrollMin = 64
+
+// MaskWith applies the masking algorithm from RFC 6455, subsection 5.3, on p
+// inline. The key is in network byte order, i.e., the first key octet is in
+// the most significant bits. Index i is the key position for the first octet
+// of p, as in the position in the payload modulo 4. The return is the key
+// position for the octet which would follow p. Masking is its own inverse.
+func maskWith(p []byte, key uint32, i uint) uint {
+	// key octets in wire order, rotated to start position
+	key = bits.RotateLeft32(key, int(8*(i&3)))
+	var k [8]byte
+	binary.BigEndian.PutUint32(k[:4], key)
+	binary.BigEndian.PutUint32(k[4:], key)
+	next := i + uint(len(p))
+
+	// native byte order matches the memory layout of both p and k
+	word := binary.NativeEndian.Uint64(k[:])
+	if len(p) >= maskUnrollMin {
+		p = maskWords32(p, word)
+	}
+	p = maskWords(p, word)
+	for j := range p {
+		p[j] ^= k[j]
+	}
+	return next & 3
+}
+
+// MaskWords applies word on each 8 octets of p. The return is the remainder.
+func maskWords(p []byte, word uint64) []byte {
+	for len(p) > 7 {
+		binary.NativeEndian.PutUint64(p, binary.NativeEndian.Uint64(p)^word)
+		p = p[8:]
+	}
+	return p
+}
+
+// MaskWords32 applies word on each 8 octets of p, 32 octets per iteration.
+// The return is the remainder.
+func maskWords32(p []byte, word uint64) []byte {
+	for len(p) > 31 {
+		q := p[:32:32] // bounds check elimination
+		binary.NativeEndian.PutUint64(q[0:], binary.NativeEndian.Uint64(q[0:])^word)
+		binary.NativeEndian.PutUint64(q[8:], binary.NativeEndian.Uint64(q[8:])^word)
+		binary.NativeEndian.PutUint64(q[16:], binary.NativeEndian.Uint64(q[16:])^word)
+		binary.NativeEndian.PutUint64(q[24:], binary.NativeEndian.Uint64(q[24:])^word)
+		p = p[32:]
+	}
+	return p
+}
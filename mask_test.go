@@ -0,0 +1,60 @@
+package websocket
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// MaskReference is a byte-order independent implementation of the masking
+// algorithm, as specified by RFC 6455, subsection 5.3.
+func maskReference(p []byte, key [4]byte, i uint) {
+	for j := range p {
+		p[j] ^= key[(i+uint(j))%4]
+	}
+}
+
+func TestMaskWith(t *testing.T) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	const keyWord = 0x12345678
+
+	rnd := rand.New(rand.NewSource(42))
+	for size := 0; size < 40; size++ {
+		for i := uint(0); i < 4; i++ {
+			want := make([]byte, size)
+			rnd.Read(want)
+			got := append([]byte(nil), want...)
+
+			maskReference(want, key, i)
+			next := maskWith(got, keyWord, i)
+			if !bytes.Equal(got, want) {
+				t.Errorf("size %d, key position %d: got %#x, want %#x", size, i, got, want)
+			}
+			if want := (i + uint(size)) % 4; next != want {
+				t.Errorf("size %d, key position %d: got next position %d, want %d", size, i, next, want)
+			}
+		}
+	}
+}
+
+func TestMaskWithSplit(t *testing.T) {
+	const keyWord = 0x12345678
+	want := make([]byte, 1024)
+	rand.New(rand.NewSource(42)).Read(want)
+	got := append([]byte(nil), want...)
+	maskWith(want, keyWord, 0)
+
+	// mask in chunks of increasing size
+	var i uint
+	p := got
+	for size := 1; len(p) != 0; size++ {
+		if size > len(p) {
+			size = len(p)
+		}
+		i = maskWith(p[:size], keyWord, i)
+		p = p[size:]
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("chunked masking differs from single pass")
+	}
+}
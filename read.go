@@ -1,9 +1,16 @@
 package websocket
 
 import (
+	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
 // ErrUnderflow enables non-blocking behaviour.
@@ -15,15 +22,35 @@ var ErrOverflow = errors.New("next WebSocket frame exceeds buffer capacity")
 // ErrReserved signals entension activity on the current frame.
 var ErrReserved = errors.New("WebSocket frame with reserved flags")
 
+// ErrFragmentOrder signals a Continuation frame without message, or a message
+// interrupted by another one.
+var ErrFragmentOrder = errors.New("WebSocket message fragments out of order")
+
+// ErrInflateLimit signals a decompressed message beyond the limit of InflateMax.
+// It should be followed up by CloseCode with TooBig.
+var ErrInflateLimit = errors.New("WebSocket message inflates beyond size limit")
+
+// ErrFragmentLimit signals a message with more frames than MaxFragments.
+var ErrFragmentLimit = errors.New("WebSocket message exceeds fragment limit")
+
 // Reader parses input from a WebSocket connection.
 // Reader can not handle frames beyond its buffer in size.
 type Reader struct {
+	// MaxFragments limits the number of frames per message, control frames
+	// excluded. NextFrame returns ErrFragmentLimit, together with the
+	// payload, on each frame beyond the limit. The zero value disables the
+	// limit.
+	MaxFragments int
+
 	buf []byte
 	err error // pending from last read
 
 	bufI int // index of position in buffer
 	bufN int // byte count of buffered data
 	next int // first index after current frame
+
+	headN int // header size of current frame
+	fragN int // data frame count of current message
 }
 
 func NewReader(buf []byte) *Reader {
@@ -73,6 +100,26 @@ func (r *Reader) ReadSome(conn io.Reader) error {
 	return nil
 }
 
+// ReadSomeDeadline does one Read like ReadSome, with a read deadline set on conn
+// first. Timeouts come as a net.Error with Timeout set, after which the Reader
+// remains usable.
+func (r *Reader) ReadSomeDeadline(conn net.Conn, deadline time.Time) error {
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	return r.ReadSome(conn)
+}
+
+// FrameHeaderLen returns the number of bytes in the header of the current
+// frame, which is one of 2, 4, 6, 8, 10 or 14. The return is zero when no frame
+// was parsed yet.
+func (r *Reader) FrameHeaderLen() int { return r.headN }
+
+// FragmentCount returns the number of frames in the current message thus far,
+// including the current frame. Control frames are not part of any message, and
+// so they leave the count as is.
+func (r *Reader) FragmentCount() int { return r.fragN }
+
 // IsFinal returns whether the current frame is the last one of the message.
 // Fragmented messages span their payload over one or more non-final frames,
 // combined with the final one.
@@ -92,24 +139,13 @@ func (r *Reader) Reserved3() bool { return r.buf[r.bufI]&0x10 != 0 }
 // of their sequence, with Continuation on all of the following frames.
 func (r *Reader) Opcode() uint { return uint(r.buf[r.bufI]) & 15 }
 
-// NextFrame slices the payload from the following frame of the read buffer. The
-// bytes stop being valid at the next invocation. Use both Opcode and FinalFrame
-// to determine on how to act upon each payload. The Reader needs more data from
-// ReadSome on ErrUnderflow. ErrOverflow should be followed up by CloseCode with
-// TooBig. ErrReserved is always returned together with the payload.
-func (r *Reader) NextFrame() (payload []byte, err error) {
-	if r.next > 0 {
-		r.passFrame()
-	}
-
-	// payload start and size encoded in header
-	var offset, byteN int
-	// frames may or may not mask their payload
-	var maskKey *[4]byte
-
-	i := r.bufI
+// FrameAt parses the header of the frame at index i of the buffer. The payload
+// starts at offset, with byteN bytes. The mask key is nil for frames without.
+func (r *Reader) frameAt(i int) (offset, byteN int, maskKey *[4]byte, err error) {
+	// payload start and size encoded in header; 63-bit sizes are bound to
+	// the buffer capacity before conversion, which keeps int safe on 32-bit
 	if i+1 >= r.bufN {
-		return nil, ErrUnderflow
+		return 0, 0, nil, ErrUnderflow
 	}
 	switch sizeHead := r.buf[i+1]; {
 
@@ -122,7 +158,7 @@ func (r *Reader) NextFrame() (payload []byte, err error) {
 		// size is 7-bit length, with mask
 		offset = i + 6
 		if offset > r.bufN {
-			return nil, ErrUnderflow
+			return 0, 0, nil, ErrUnderflow
 		}
 		maskKey = (*[4]byte)(r.buf[i+2 : offset])
 		byteN = int(uint(sizeHead & 0x7f))
@@ -131,7 +167,7 @@ func (r *Reader) NextFrame() (payload []byte, err error) {
 		// 16-bit length follows, no mask
 		offset = i + 4
 		if offset > r.bufN {
-			return nil, ErrUnderflow
+			return 0, 0, nil, ErrUnderflow
 		}
 		byteN = int(uint(binary.BigEndian.Uint16(r.buf[i+2 : offset])))
 
@@ -139,7 +175,7 @@ func (r *Reader) NextFrame() (payload []byte, err error) {
 		// 16-bit length follows, with mask
 		offset = i + 8
 		if offset > r.bufN {
-			return nil, ErrUnderflow
+			return 0, 0, nil, ErrUnderflow
 		}
 		byteN = int(uint(binary.BigEndian.Uint16(r.buf[i+2 : i+4])))
 		maskKey = (*[4]byte)(r.buf[i+4 : offset])
@@ -148,12 +184,12 @@ func (r *Reader) NextFrame() (payload []byte, err error) {
 		// 63-bit length follows, no mask
 		offset = i + 10
 		if offset > r.bufN {
-			return nil, ErrUnderflow
+			return 0, 0, nil, ErrUnderflow
 		}
 		n := binary.BigEndian.Uint64(r.buf[i+2 : offset])
 		if n > uint64(len(r.buf)) {
 			// spec allows up to 8 PiB 🤡
-			return nil, ErrOverflow
+			return 0, 0, nil, ErrOverflow
 		}
 		byteN = int(n)
 
@@ -161,49 +197,234 @@ func (r *Reader) NextFrame() (payload []byte, err error) {
 		// 63-bit length follows, with mask
 		offset = i + 14
 		if offset > r.bufN {
-			return nil, ErrUnderflow
+			return 0, 0, nil, ErrUnderflow
 		}
 		n := binary.BigEndian.Uint64(r.buf[i+2 : i+10])
 		if n > uint64(len(r.buf)) {
 			// spec allows up to 8 PiB 🤡
-			return nil, ErrOverflow
+			return 0, 0, nil, ErrOverflow
 		}
 		byteN = int(n)
 		maskKey = (*[4]byte)(r.buf[i+10 : offset])
 	}
 
-	end := offset + byteN
-	if end > r.bufN {
-		return nil, ErrUnderflow
+	if offset+byteN > r.bufN {
+		return 0, 0, nil, ErrUnderflow
 	}
+	return offset, byteN, maskKey, nil
+}
+
+// NextFrame slices the payload from the following frame of the read buffer. The
+// bytes stop being valid at the next invocation. Use both Opcode and FinalFrame
+// to determine on how to act upon each payload. The Reader needs more data from
+// ReadSome on ErrUnderflow. ErrOverflow should be followed up by CloseCode with
+// TooBig. ErrReserved is always returned together with the payload.
+func (r *Reader) NextFrame() (payload []byte, err error) {
+	if r.next > 0 {
+		r.passFrame()
+	}
+
+	offset, byteN, maskKey, err := r.frameAt(r.bufI)
+	if err != nil {
+		return nil, err
+	}
+	end := offset + byteN
 	payload = r.buf[offset:end:end]
 	// frame cursor accepted by setting next
 	r.next = end
+	r.headN = offset - r.bufI
 
 	if maskKey != nil {
-		xorWith(payload, maskKey)
+		maskWith(payload, binary.BigEndian.Uint32(maskKey[:]), 0)
 	}
+
+	if head := r.buf[r.bufI]; head&ctrlFlag == 0 {
+		if head&opcodeMask == Continuation {
+			r.fragN++
+		} else {
+			r.fragN = 1 // new message
+		}
+		if r.MaxFragments > 0 && r.fragN > r.MaxFragments {
+			return payload, ErrFragmentLimit
+		}
+	}
+
 	if r.buf[r.bufI]&0x70 != 0 {
 		return payload, ErrReserved
 	}
 	return payload, nil
 }
 
-// XorWith masks/unmasks a payload inline with the key.
-func xorWith(p []byte, key *[4]byte) {
-	r32 := binary.NativeEndian.Uint32(key[:4])
-	r64 := uint64(r32)<<32 | uint64(r32)
-	for len(p) > 7 {
-		flipped := binary.NativeEndian.Uint64(p) ^ r64
-		binary.NativeEndian.PutUint64(p, flipped)
-		p = p[8:]
-	}
-	if len(p) > 3 {
-		flipped := binary.NativeEndian.Uint32(p) ^ r32
-		binary.NativeEndian.PutUint32(p, flipped)
-		p = p[4:]
-	}
-	for i := range p {
-		p[i] ^= key[i]
+// NextMessage slices the payload from the following message of the read buffer,
+// with all of its fragments joined. The fragments are compacted in place, which
+// needs the message to fit the buffer in full, headers included. The bytes stop
+// being valid at the next invocation. The Reader needs more data from ReadSome
+// on ErrUnderflow. ErrOverflow signals a message beyond the buffer capacity.
+// ErrReserved is returned together with the payload when any of the frames has
+// reserved flags. ErrFragmentLimit applies like it does with NextFrame.
+//
+// Control frames are not part of any message. They are returned on their own,
+// in order of arrival, conform NextFrame. The opcode return tells them apart.
+// Control frames which interrupt a message are returned before the message.
+// The frame methods, like Opcode, IsFinal and FrameHeaderLen, apply to the
+// first frame of the message.
+func (r *Reader) NextMessage() (opcode uint, payload []byte, err error) {
+	if r.next > 0 {
+		r.passFrame()
+	}
+
+	// locate the final frame
+	start := r.bufI
+	for i := start; ; {
+		offset, byteN, _, err := r.frameAt(i)
+		if err != nil {
+			if err == ErrUnderflow && start == 0 && r.bufN == len(r.buf) {
+				err = ErrOverflow // no space left
+			}
+			return 0, nil, err
+		}
+		end := offset + byteN
+		head := r.buf[i]
+
+		if head&ctrlFlag != 0 {
+			if i != start {
+				// move control frame in front of the message
+				rotate(r.buf[start:end], i-start)
+			}
+			payload, err := r.NextFrame()
+			return r.Opcode(), payload, err
+		}
+		if (i == start) != (head&opcodeMask != Continuation) {
+			return 0, nil, ErrFragmentOrder
+		}
+		if head&finalFlag != 0 {
+			break
+		}
+		i = end
+	}
+
+	// join fragments after the payload of the first frame
+	opcode = r.Opcode()
+	var payloadI, payloadN, fragN int
+	var reserved byte
+	for i := start; ; {
+		offset, byteN, maskKey, _ := r.frameAt(i)
+		end := offset + byteN
+		p := r.buf[offset:end]
+		if maskKey != nil {
+			maskWith(p, binary.BigEndian.Uint32(maskKey[:]), 0)
+		}
+		head := r.buf[i]
+		reserved |= head & 0x70
+		fragN++
+
+		if i == start {
+			payloadI = offset
+			r.headN = offset - i
+		} else {
+			copy(r.buf[payloadI+payloadN:], p)
+		}
+		payloadN += byteN
+
+		if head&finalFlag != 0 {
+			// frame cursor accepted by setting next
+			r.next = end
+			break
+		}
+		i = end
+	}
+	r.fragN = fragN
+	payload = r.buf[payloadI : payloadI+payloadN : payloadI+payloadN]
+
+	if r.MaxFragments > 0 && fragN > r.MaxFragments {
+		return opcode, payload, ErrFragmentLimit
+	}
+	if reserved != 0 {
+		return opcode, payload, ErrReserved
+	}
+	return opcode, payload, nil
+}
+
+// Rotate moves p[k:] in front of p[:k], in place.
+func rotate(p []byte, k int) {
+	reverse(p[:k])
+	reverse(p[k:])
+	reverse(p)
+}
+
+func reverse(p []byte) {
+	for i, j := 0, len(p)-1; i < j; i, j = i+1, j-1 {
+		p[i], p[j] = p[j], p[i]
+	}
+}
+
+// InflatePool holds flate readers for reuse.
+var inflatePool sync.Pool
+
+// Inflate appends the decompressed payload of a message to dst. The payload must
+// be the concatenation of all frames in the message, with Reserved1 set on the
+// first frame, conform “Compression Extensions for WebSocket” RFC 7692. Each
+// message is inflated on its own, i.e., only negotiation without any context
+// takeover is supported. Decompression state is pooled for reuse.
+func Inflate(dst, payload []byte) ([]byte, error) {
+	return inflate(dst, payload, -1)
+}
+
+// InflateMax is like Inflate, with a limit on the number of bytes appended to
+// dst. Decompression stops with ErrInflateLimit as soon as the output exceeds
+// max bytes. Small payloads may inflate to enormous sizes, i.e., a compression
+// bomb. Any limit on message sizes should thus apply to the inflated size, as
+// opposed to the size of the payload received.
+func InflateMax(dst, payload []byte, max int) ([]byte, error) {
+	return inflate(dst, payload, max)
+}
+
+// Inflate implements Inflate with a limit on the output size, with a negative
+// max for none.
+func inflate(dst, payload []byte, max int) ([]byte, error) {
+	// restore the tail stripped by the sender, plus an empty final block
+	r := io.MultiReader(bytes.NewReader(payload), strings.NewReader("\x00\x00\xff\xff\x01\x00\x00\xff\xff"))
+
+	var fr io.ReadCloser
+	if v := inflatePool.Get(); v != nil {
+		fr = v.(io.ReadCloser)
+		if err := fr.(flate.Resetter).Reset(r, nil); err != nil {
+			return dst, err
+		}
+	} else {
+		fr = flate.NewReader(r)
+	}
+	defer inflatePool.Put(fr)
+
+	// Limits beyond the maximum slice size can't be reached. The limit plus
+	// one (byte) must not overflow.
+	limited := max >= 0 && max < math.MaxInt-len(dst)
+	limit := len(dst) + max
+	for {
+		if limited && len(dst) > limit {
+			return dst[:limit], ErrInflateLimit
+		}
+		if len(dst) == cap(dst) {
+			// grow capacity
+			dst = append(dst, 0)[:len(dst)]
+		}
+		buf := dst[len(dst):cap(dst)]
+		if limited && len(buf) > limit+1-len(dst) {
+			// one byte beyond limit detects excess
+			buf = buf[:limit+1-len(dst)]
+		}
+		n, err := fr.Read(buf)
+		dst = dst[:len(dst)+n]
+		switch err {
+		case nil:
+			continue
+		case io.EOF:
+			if limited && len(dst) > limit {
+				return dst[:limit], ErrInflateLimit
+			}
+			return dst, nil
+		default:
+			return dst, err
+		}
 	}
 }
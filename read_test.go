@@ -2,9 +2,13 @@ package websocket
 
 import (
 	"bytes"
+	"compress/flate"
+	"math"
+	"net"
 	"strings"
 	"testing"
 	"testing/iotest"
+	"time"
 )
 
 func TestSmallReads(t *testing.T) {
@@ -102,3 +106,251 @@ func TestPingBetweenFragments(t *testing.T) {
 		t.Error("3rd frame got not IsFinal")
 	}
 }
+
+func TestNextMessage(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("\x01\x86\x00\x00\x00\x00Hello ")
+	buf.WriteString("\x89\x84\x00\x00\x00\x00🔔")
+	buf.WriteString("\x80\x86\x00\x00\x00\x00World!")
+	buf.WriteString(GoldenFrames[2].Masked)
+	want := []string{"🔔", "Hello World!", GoldenFrames[2].Message}
+	wantOpcodes := []uint{Ping, Text, GoldenFrames[2].Opcode}
+	for _, gold := range GoldenFragments {
+		buf.WriteString(strings.Join(gold.Maskeds, ""))
+		want = append(want, strings.Join(gold.Messages, ""))
+		wantOpcodes = append(wantOpcodes, gold.Opcode)
+	}
+
+	r := NewReader(make([]byte, 512))
+	if err := r.ReadSome(&buf); err != nil {
+		t.Fatal("ReadSome produced an error (not from the Reader):", err)
+	}
+	for i := range want {
+		opcode, payload, err := r.NextMessage()
+		if err != nil {
+			t.Fatalf("message %d got error: %s", i, err)
+		}
+		if opcode != wantOpcodes[i] || string(payload) != want[i] {
+			t.Errorf("message %d got opcode %d with %q, want opcode %d with %q", i, opcode, payload, wantOpcodes[i], want[i])
+		}
+	}
+	if _, _, err := r.NextMessage(); err != ErrUnderflow {
+		t.Errorf("got error %v after all messages, want ErrUnderflow", err)
+	}
+
+	// two fragments of 12 bytes each exceed 16 bytes
+	r = NewReader(make([]byte, 16))
+	buf.WriteString("\x01\x86\x00\x00\x00\x00Hello \x80\x86\x00\x00\x00\x00World!")
+	for {
+		_, _, err := r.NextMessage()
+		if err == ErrUnderflow {
+			if err := r.ReadSome(&buf); err != nil {
+				t.Fatal("ReadSome produced an error (not from the Reader):", err)
+			}
+			continue
+		}
+		if err != ErrOverflow {
+			t.Errorf("got error %v, want ErrOverflow", err)
+		}
+		break
+	}
+
+	r = NewReader(make([]byte, 16))
+	buf.Reset()
+	buf.WriteString("\x80\x80\x00\x00\x00\x00")
+	r.ReadSome(&buf)
+	if _, _, err := r.NextMessage(); err != ErrFragmentOrder {
+		t.Errorf("anonymous continuation got error %v, want ErrFragmentOrder", err)
+	}
+}
+
+func TestReadSomeDeadline(t *testing.T) {
+	conn, testEnd := net.Pipe()
+	defer conn.Close()
+	defer testEnd.Close()
+
+	r := NewReader(make([]byte, 512))
+	err := r.ReadSomeDeadline(conn, time.Now().Add(time.Millisecond))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("got error %v, want a net.Error timeout", err)
+	}
+
+	go testEnd.Write([]byte("\x82\x03foo"))
+	if err := r.ReadSomeDeadline(conn, time.Now().Add(time.Second)); err != nil {
+		t.Fatal("ReadSomeDeadline got error:", err)
+	}
+	payload, err := r.NextFrame()
+	if err != nil || string(payload) != "foo" {
+		t.Errorf("NextFrame got %q with error %v, want \"foo\"", payload, err)
+	}
+}
+
+func TestReaderSizeOverflow(t *testing.T) {
+	golden := []string{
+		// 3 GiB wraps to negative on 32-bit platforms
+		"\x82\x7f\x00\x00\x00\x00\xc0\x00\x00\x00",
+		"\x82\xff\x00\x00\x00\x00\xc0\x00\x00\x00\x00\x00\x00\x00",
+		// 63-bit maximum
+		"\x82\x7f\x7f\xff\xff\xff\xff\xff\xff\xff",
+		// 64-bit maximum violates the specification
+		"\x82\xff\xff\xff\xff\xff\xff\xff\xff\xff\x00\x00\x00\x00",
+	}
+	for _, frame := range golden {
+		r := NewReader(make([]byte, 4096))
+		if err := r.ReadSome(strings.NewReader(frame)); err != nil {
+			t.Fatal("ReadSome got error:", err)
+		}
+		payload, err := r.NextFrame()
+		if err != ErrOverflow {
+			t.Errorf("%#x: got %d bytes payload with error %v, want ErrOverflow", frame, len(payload), err)
+		}
+	}
+}
+
+func TestFrameHeaderLen(t *testing.T) {
+	golden := []struct {
+		Frame string
+		Want  int
+	}{
+		{"\x82\x00", 2},
+		{"\x82\x80\x00\x00\x00\x00", 6},
+		{"\x82\x7e\x00\x01a", 4},
+		{"\x82\xfe\x00\x01\x00\x00\x00\x00a", 8},
+		{"\x82\x7f\x00\x00\x00\x00\x00\x00\x00\x01a", 10},
+		{"\x82\xff\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00a", 14},
+	}
+
+	var all strings.Builder
+	for _, gold := range golden {
+		all.WriteString(gold.Frame)
+	}
+	r := NewReader(make([]byte, 4096))
+	if n := r.FrameHeaderLen(); n != 0 {
+		t.Errorf("got header length %d before any frame, want 0", n)
+	}
+	if err := r.ReadSome(strings.NewReader(all.String())); err != nil {
+		t.Fatal("ReadSome got error:", err)
+	}
+	for _, gold := range golden {
+		if _, err := r.NextFrame(); err != nil {
+			t.Fatalf("%#x: NextFrame got error: %s", gold.Frame, err)
+		}
+		if n := r.FrameHeaderLen(); n != gold.Want {
+			t.Errorf("%#x: got header length %d, want %d", gold.Frame, n, gold.Want)
+		}
+	}
+}
+
+func TestFragmentLimit(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("\x01\x01a") // text start
+	buf.WriteString("\x89\x00")  // ping
+	buf.WriteString("\x00\x01b") // continuation
+	buf.WriteString("\x80\x01c") // final continuation
+	buf.WriteString("\x82\x01d") // binary, unfragmented
+
+	r := NewReader(make([]byte, 4096))
+	r.MaxFragments = 2
+	if err := r.ReadSome(&buf); err != nil {
+		t.Fatal("ReadSome got error:", err)
+	}
+
+	golden := []struct {
+		Payload string
+		Count   int
+		Err     error
+	}{
+		{"a", 1, nil},
+		{"", 1, nil},
+		{"b", 2, nil},
+		{"c", 3, ErrFragmentLimit},
+		{"d", 1, nil},
+	}
+	for i, gold := range golden {
+		payload, err := r.NextFrame()
+		if string(payload) != gold.Payload || err != gold.Err {
+			t.Errorf("frame %d: got %q with error %v, want %q with error %v", i, payload, err, gold.Payload, gold.Err)
+		}
+		if n := r.FragmentCount(); n != gold.Count {
+			t.Errorf("frame %d: got fragment count %d, want %d", i, n, gold.Count)
+		}
+	}
+}
+
+func TestInflate(t *testing.T) {
+	const frame = "\xc1\x07\xf2\x48\xcd\xc9\xc9\x07\x00" // RFC 7692, subsection 7.2.3.1
+
+	r := NewReader(make([]byte, 4096))
+	if err := r.ReadSome(strings.NewReader(frame)); err != nil {
+		t.Fatal("ReadSome got error:", err)
+	}
+	payload, err := r.NextFrame()
+	if err != ErrReserved || !r.Reserved1() {
+		t.Fatalf("NextFrame got error %v with Reserved1 %t, want ErrReserved with Reserved1", err, r.Reserved1())
+	}
+	got, err := Inflate(nil, payload)
+	if err != nil || string(got) != "Hello" {
+		t.Errorf("got %q with error %v, want \"Hello\"", got, err)
+	}
+
+	// round trip with pooled state
+	message := strings.Repeat(`{"key":"value"},`, 1000)
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(message))
+	w.Flush()
+	compressed := bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})
+	for i := 0; i < 2; i++ {
+		got, err := Inflate([]byte("prefix"), compressed)
+		if err != nil || string(got) != "prefix"+message {
+			t.Errorf("round trip %d got %d bytes with error %v, want %d bytes", i, len(got), err, len("prefix"+message))
+		}
+	}
+
+	if _, err := Inflate(nil, []byte{0xff, 0xff}); err == nil {
+		t.Error("corrupt input got no error")
+	}
+}
+
+func TestInflateMax(t *testing.T) {
+	// highly compressible
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(make([]byte, 1<<20))
+	w.Flush()
+	bomb := bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})
+	if len(bomb) > 4096 {
+		t.Fatalf("got %d bytes compressed, want a bomb", len(bomb))
+	}
+
+	got, err := InflateMax([]byte("prefix"), bomb, 64*1024)
+	if err != ErrInflateLimit {
+		t.Errorf("got error %v, want ErrInflateLimit", err)
+	}
+	if len(got) != len("prefix")+64*1024 {
+		t.Errorf("got %d bytes, want limit of %d", len(got), len("prefix")+64*1024)
+	}
+
+	got, err = InflateMax(nil, bomb, 1<<20)
+	if err != nil || len(got) != 1<<20 {
+		t.Errorf("exact limit got %d bytes with error %v, want %d bytes", len(got), err, 1<<20)
+	}
+	got, err = InflateMax(nil, bomb, 1<<20-1)
+	if err != ErrInflateLimit {
+		t.Errorf("one byte short got %d bytes with error %v, want ErrInflateLimit", len(got), err)
+	}
+
+	// no overflow on limit
+	for _, dst := range [][]byte{nil, []byte("prefix")} {
+		got, err = InflateMax(dst, bomb, math.MaxInt)
+		if err != nil || len(got) != len(dst)+1<<20 {
+			t.Errorf("max MaxInt got %d bytes with error %v, want %d bytes", len(got), err, len(dst)+1<<20)
+		}
+	}
+}
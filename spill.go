@@ -0,0 +1,95 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+)
+
+// ReceiveSpill is an alternative to ReceiveBuffer for large messages. Messages
+// up to threshold bytes are held in memory. Larger ones go into a temporary
+// file, created in dir, or in the default directory from os.TempDir when dir is
+// empty. Messages which exceed max are rejected with ErrOverflow, after a
+// connection Close with status code 1009 [TooBig]. The opcode return is in range
+// [1, 7]. Control frames are dealed with.
+//
+// The message return is positioned at the start. Close releases its resources,
+// which includes removal of any temporary file. The caller must Close each
+// message return, even when unread. No message is returned on error, and any
+// temporary file is removed in such case.
+//
+// WireTimeout is the limit for Read [frame receival] and idleTimeout limits
+// the amount of time to wait for arrival.
+func (c *Conn) ReceiveSpill(threshold int, max int64, dir string, wireTimeout, idleTimeout time.Duration) (opcode uint, message io.ReadSeekCloser, err error) {
+	opcode, r, err := c.ReceiveStream(wireTimeout, idleTimeout)
+	if err != nil {
+		return opcode, nil, err
+	}
+
+	// one byte extra detects spill
+	var buf bytes.Buffer
+	if int64(threshold) > max {
+		threshold = int(max)
+	}
+	n, err := buf.ReadFrom(io.LimitReader(r, overflowLimit(int64(threshold))))
+	if err != nil {
+		return opcode, nil, err
+	}
+	if n <= int64(threshold) {
+		return opcode, memorySpill{bytes.NewReader(buf.Bytes())}, nil
+	}
+	if n > max {
+		c.SendClose(TooBig, "")
+		return opcode, nil, ErrOverflow
+	}
+
+	f, err := os.CreateTemp(dir, "websocket-message-*")
+	if err != nil {
+		return opcode, nil, err
+	}
+	file := fileSpill{f}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return opcode, nil, err
+	}
+
+	// one byte extra detects overflow
+	more, err := io.Copy(f, io.LimitReader(r, overflowLimit(max)-n))
+	if err != nil {
+		file.Close()
+		return opcode, nil, err
+	}
+	if n+more > max {
+		file.Close()
+		c.SendClose(TooBig, "")
+		return opcode, nil, ErrOverflow
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return opcode, nil, err
+	}
+	return opcode, file, nil
+}
+
+// MemorySpill is a message from ReceiveSpill held in memory.
+type memorySpill struct {
+	*bytes.Reader
+}
+
+// Close implements the io.Closer interface.
+func (m memorySpill) Close() error { return nil }
+
+// FileSpill is a message from ReceiveSpill in a temporary file.
+type fileSpill struct {
+	*os.File
+}
+
+// Close implements the io.Closer interface. The file is removed.
+func (f fileSpill) Close() error {
+	err := f.File.Close()
+	if removeErr := os.Remove(f.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"io"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReceiveSpill(t *testing.T) {
+	dir := t.TempDir()
+	conn, testEnd := pipeConn()
+	go func() {
+		io.WriteString(testEnd, zeroMaskFrame(Text|finalFlag, "abc"))
+		io.WriteString(testEnd, zeroMaskFrame(Binary, "defg")+zeroMaskFrame(Continuation|finalFlag, "hij"))
+		io.WriteString(testEnd, zeroMaskFrame(Binary|finalFlag, "0123456789"))
+		io.Copy(io.Discard, testEnd)
+	}()
+
+	// in memory
+	opcode, message, err := conn.ReceiveSpill(4, 8, dir, time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	got, err := io.ReadAll(message)
+	if err != nil || opcode != Text || string(got) != "abc" {
+		t.Errorf("got opcode %d, message %q, error %v; want text \"abc\"", opcode, got, err)
+	}
+	message.Close()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("got %d files for message in memory, want none", len(entries))
+	}
+
+	// spill
+	opcode, message, err = conn.ReceiveSpill(4, 8, dir, time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("got %d files for spilled message, want one", len(entries))
+	}
+	got, err = io.ReadAll(message)
+	if err != nil || opcode != Binary || string(got) != "defghij" {
+		t.Errorf("got opcode %d, message %q, error %v; want binary \"defghij\"", opcode, got, err)
+	}
+	if _, err := message.Seek(3, io.SeekStart); err != nil {
+		t.Error("seek error:", err)
+	}
+	if got, _ := io.ReadAll(message); string(got) != "ghij" {
+		t.Errorf("got %q after seek, want \"ghij\"", got)
+	}
+	if err := message.Close(); err != nil {
+		t.Error("close error:", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("got %d files after close, want none", len(entries))
+	}
+
+	// overflow
+	if _, _, err := conn.ReceiveSpill(4, 8, dir, time.Second, time.Second); err != ErrOverflow {
+		t.Errorf("got error %v, want ErrOverflow", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("got %d files after overflow, want none", len(entries))
+	}
+	if got := conn.Stats().CloseCode; got != TooBig {
+		t.Errorf("got close code %d, want %d", got, TooBig)
+	}
+}
+
+func TestReceiveSpillMaxInt(t *testing.T) {
+	dir := t.TempDir()
+	conn, testEnd := pipeConn()
+	go func() {
+		io.WriteString(testEnd, zeroMaskFrame(Binary|finalFlag, "abc")+zeroMaskFrame(Binary|finalFlag, "defg"))
+		io.Copy(io.Discard, testEnd)
+	}()
+
+	golden := []struct {
+		Threshold int
+		Want      string
+	}{
+		{math.MaxInt, "abc"},
+		{2, "defg"}, // spill
+	}
+	for _, gold := range golden {
+		_, message, err := conn.ReceiveSpill(gold.Threshold, math.MaxInt64, dir, time.Second, time.Second)
+		if err != nil {
+			t.Fatalf("threshold %d: receive error: %s", gold.Threshold, err)
+		}
+		got, err := io.ReadAll(message)
+		message.Close()
+		if err != nil || string(got) != gold.Want {
+			t.Errorf("threshold %d: got message %q with error %v, want %q", gold.Threshold, got, err, gold.Want)
+		}
+	}
+}
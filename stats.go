@@ -0,0 +1,69 @@
+package websocket
+
+import "sync/atomic"
+
+// ConnStats is a snapshot of the connection activity. Frames include both
+// data and control frames. Messages count final data frames only.
+type ConnStats struct {
+	// Number of bytes on the wire, including frame headers.
+	ReadBytes, WrittenBytes uint64
+	// Number of frames, including control frames.
+	ReadFrames, WrittenFrames uint64
+	// Number of data messages completed.
+	ReadMessages, WrittenMessages uint64
+	// Number of Ping control frames.
+	ReadPings, WrittenPings uint64
+	// Number of Pong control frames.
+	ReadPongs, WrittenPongs uint64
+
+	// CloseCode is the status code in effect, or zero when not closed.
+	CloseCode uint
+}
+
+// Stats returns the current counters. Stats may be invoked simultaneously
+// with any other method from Conn. Counters are read one by one, so the
+// snapshot may be off by the operations in flight.
+func (c *Conn) Stats() ConnStats {
+	s := ConnStats{
+		ReadBytes:       atomic.LoadUint64(&c.readByteN),
+		WrittenBytes:    atomic.LoadUint64(&c.writeByteN),
+		ReadFrames:      atomic.LoadUint64(&c.readFrameN),
+		WrittenFrames:   atomic.LoadUint64(&c.writeFrameN),
+		ReadMessages:    atomic.LoadUint64(&c.readMessageN),
+		WrittenMessages: atomic.LoadUint64(&c.writeMessageN),
+		ReadPings:       atomic.LoadUint64(&c.readPingN),
+		WrittenPings:    atomic.LoadUint64(&c.writePingN),
+		ReadPongs:       atomic.LoadUint64(&c.readPongN),
+		WrittenPongs:    atomic.LoadUint64(&c.writePongN),
+	}
+	if statusCode := atomic.LoadUint32(&c.statusCode); statusCode != 0 {
+		s.CloseCode = uint(statusCode & statusCodeMask)
+	}
+	return s
+}
+
+// CountReadFrame registers a frame by its first byte.
+func (c *Conn) countReadFrame(head uint) {
+	atomic.AddUint64(&c.readFrameN, 1)
+	switch {
+	case head&opcodeMask == Ping:
+		atomic.AddUint64(&c.readPingN, 1)
+	case head&opcodeMask == Pong:
+		atomic.AddUint64(&c.readPongN, 1)
+	case head&(ctrlFlag|finalFlag) == finalFlag:
+		atomic.AddUint64(&c.readMessageN, 1)
+	}
+}
+
+// CountWriteFrame registers a frame by its first byte.
+func (c *Conn) countWriteFrame(head uint) {
+	atomic.AddUint64(&c.writeFrameN, 1)
+	switch {
+	case head&opcodeMask == Ping:
+		atomic.AddUint64(&c.writePingN, 1)
+	case head&opcodeMask == Pong:
+		atomic.AddUint64(&c.writePongN, 1)
+	case head&(ctrlFlag|finalFlag) == finalFlag:
+		atomic.AddUint64(&c.writeMessageN, 1)
+	}
+}
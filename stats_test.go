@@ -0,0 +1,59 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	conn, testEnd := pipeConn()
+
+	const frames = "\x01\x85\x00\x00\x00\x00Hello" +
+		"\x89\x81\x00\x00\x00\x00." +
+		"\x80\x86\x00\x00\x00\x00 World"
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		var buf bytes.Buffer
+		buf.ReadFrom(testEnd)
+	}()
+	go func() {
+		defer wg.Done()
+		if _, err := io.WriteString(testEnd, frames); err != nil {
+			t.Error("test end write error:", err)
+		}
+	}()
+
+	var buf [100]byte
+	if _, _, err := conn.Receive(buf[:], time.Second, time.Second); err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if err := conn.Send(Binary, []byte{1, 2, 3}, time.Second); err != nil {
+		t.Fatal("send error:", err)
+	}
+	conn.SendClose(NormalClose, "")
+	conn.Close()
+	wg.Wait()
+
+	got := conn.Stats()
+	want := ConnStats{
+		ReadBytes:       uint64(len(frames)),
+		WrittenBytes:    3 + 5 + 4, // pong, binary, close
+		ReadFrames:      3,
+		WrittenFrames:   3,
+		ReadMessages:    1,
+		WrittenMessages: 1,
+		ReadPings:       1,
+		WrittenPongs:    1,
+		CloseCode:       NormalClose,
+	}
+	if got != want {
+		t.Errorf("got  %+v", got)
+		t.Errorf("want %+v", want)
+	}
+}
@@ -0,0 +1,41 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrNoTag rejects an empty message from ReceiveTagged.
+var ErrNoTag = errors.New("websocket: tagged message without tag")
+
+// SendTagged is like Send, with tag as the first byte of the message, followed
+// by payload. Tags are a light alternative to envelopes like JSON, e.g., for a
+// message type or a sequence number. Note that tags are a convention of this
+// package, and not part of WebSocket. Both ends must agree on their use.
+//
+// The message goes out without copy, conform SendBuffers. Text with a tag
+// outside of the ASCII range [0, 127] is rejected with ErrUTF8, as such tag
+// would break the UTF-8 encoding.
+func (c *Conn) SendTagged(tag byte, opcode uint, payload []byte, wireTimeout time.Duration) error {
+	if opcode == Text && tag >= 0x80 {
+		return ErrUTF8
+	}
+	tagBuf := [1]byte{tag}
+	return c.SendBuffers(opcode, net.Buffers{tagBuf[:], payload}, wireTimeout)
+}
+
+// ReceiveTagged is like Receive, for messages from SendTagged. The payload
+// return is a slice of buf, with the tag excluded. Messages without any tag,
+// i.e., empty messages, fail with ErrNoTag. The connection remains usable in
+// such case.
+func (c *Conn) ReceiveTagged(buf []byte, wireTimeout, idleTimeout time.Duration) (tag byte, opcode uint, payload []byte, err error) {
+	opcode, n, err := c.Receive(buf, wireTimeout, idleTimeout)
+	if err != nil {
+		return 0, opcode, buf[:n], err
+	}
+	if n == 0 {
+		return 0, opcode, buf[:0], ErrNoTag
+	}
+	return buf[0], opcode, buf[1:n], nil
+}
@@ -0,0 +1,46 @@
+package websocket
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTagged(t *testing.T) {
+	conn, testEnd := pipeConn()
+	done := make(chan string)
+	go func() {
+		var got strings.Builder
+		io.Copy(&got, testEnd)
+		done <- got.String()
+	}()
+
+	if err := conn.SendTagged(7, Binary, []byte("abc"), time.Second); err != nil {
+		t.Error("send error:", err)
+	}
+	if err := conn.SendTagged(0x80, Text, []byte("abc"), time.Second); err != ErrUTF8 {
+		t.Errorf("send text with tag 0x80 got error %v, want %v", err, ErrUTF8)
+	}
+	conn.Close()
+	if got, want := <-done, "\x82\x04\x07abc"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	conn, testEnd = pipeConn()
+	go func() {
+		io.WriteString(testEnd, "\x81\x84\x00\x00\x00\x00*abc"+"\x82\x80\x00\x00\x00\x00")
+		io.Copy(io.Discard, testEnd)
+	}()
+	var buf [8]byte
+	tag, opcode, payload, err := conn.ReceiveTagged(buf[:], time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if tag != '*' || opcode != Text || string(payload) != "abc" {
+		t.Errorf("got tag %q, opcode %d, payload %q; want '*', text, \"abc\"", tag, opcode, payload)
+	}
+	if _, _, _, err := conn.ReceiveTagged(buf[:], time.Second, time.Second); err != ErrNoTag {
+		t.Errorf("empty message got error %v, want %v", err, ErrNoTag)
+	}
+}
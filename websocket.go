@@ -2,10 +2,13 @@
 package websocket
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unicode/utf8"
@@ -47,6 +50,13 @@ const (
 	Reserved15
 )
 
+// IsControl returns whether opcode is for a control frame, i.e., Close, Ping,
+// Pong or one of the reserved control opcodes. Control frames may appear in the
+// middle of a fragmented message. Opcodes out of range [0, 15] are not control.
+func IsControl(opcode uint) bool {
+	return opcode&ctrlFlag != 0 && opcode <= opcodeMask
+}
+
 // Defined Status Codes
 const (
 	// NormalClose means that the purpose for which the connection was
@@ -76,7 +86,24 @@ const (
 	Unexpected = 1011
 )
 
-var errUTF8 = errors.New("websocket: invalid UTF-8 sequence in text payload")
+// ErrUTF8 rejects Text with an illegal UTF-8 sequence, as received or as
+// send with ValidateOutgoingText.
+var ErrUTF8 = errors.New("websocket: invalid UTF-8 sequence in text payload")
+
+// ErrOpcodeRange rejects a message with an opcode out of range [1, 15].
+var ErrOpcodeRange = errors.New("websocket: opcode out of range [1, 15]")
+
+// ErrStreamBusy rejects a data message while the stream from SendStream is not
+// closed yet.
+var ErrStreamBusy = errors.New("websocket: send stream in progress")
+
+// ErrWriteMode rejects a frame from SendStream when SetWriteMode was applied
+// from elsewhere. Nothing is written in such case.
+var ErrWriteMode = errors.New("websocket: write mode changed during send stream")
+
+// ErrWouldBlock rejects a stream write when the queue conform StreamBufferSize
+// is full.
+var ErrWouldBlock = errors.New("websocket: send stream queue full")
 
 // ClosedError is a status code. Atomic Close support prevents Go issue 4373.
 // Even after receiving a ClosedError, Conn.Close must still be called.
@@ -111,11 +138,40 @@ func (e ClosedError) Temporary() bool { return false }
 // Multiple goroutines may invoke SendClose simultaneously. SendClose may be
 // invoked simultaneously with any other method from Conn.
 func (c *Conn) SendClose(statusCode uint, reason string) error {
+	return c.sendClose(statusCode, reason, 0)
+}
+
+// SendClose does a SendClose with the cause as an index in violations, or zero
+// for none.
+func (c *Conn) sendClose(statusCode uint, reason string, cause uint32) error {
+	if !atomic.CompareAndSwapUint32(&c.statusCode, 0, uint32(statusCode|statusCodeSetFlag)|cause<<causeShift) {
+		// already closed
+		return c.closeError()
+	}
+	c.signalClose()
+	c.writeClose(statusCode, reason)
+	return ClosedError(statusCode)
+}
+
+// ReceivedClose replies to a Close from the peer, conform CloseReply. The
+// return is a ClosedError with the status code received, conform SendClose.
+func (c *Conn) receivedClose(statusCode uint, reason string) error {
+	if c.CloseReply == nil {
+		return c.SendClose(statusCode, reason)
+	}
 	if !atomic.CompareAndSwapUint32(&c.statusCode, 0, uint32(statusCode|statusCodeSetFlag)) {
 		// already closed
 		return c.closeError()
 	}
+	c.signalClose()
+	c.writeClose(c.CloseReply(statusCode, reason))
+	return ClosedError(statusCode)
+}
 
+// WriteClose sends a Close frame on best effort basis. Status codes which must
+// not be send result in a Close frame without payload. So does an invalid
+// reason.
+func (c *Conn) writeClose(statusCode uint, reason string) {
 	// “range 0-999 are not used” and the others “MUST NOT be set”
 	send := statusCode > 999 && statusCode != NoStatusCode && statusCode != AbnormalClose && statusCode != 1015
 
@@ -127,64 +183,439 @@ func (c *Conn) SendClose(statusCode uint, reason string) error {
 	c.writeMutex.Lock()
 	// best effort close notification; no pending errors
 	if c.writeBufN == 0 && c.writePayloadN == 0 {
+		if c.HalfDuplex {
+			c.duplexMutex.Lock()
+		}
+		c.acquireWriteBuf()
+		c.countWriteFrame(Close | finalFlag)
 		c.writeBuf[0] = Close | finalFlag
 		if !send {
 			c.writeBuf[1] = 0
-			c.Conn.Write(c.writeBuf[:2])
+			c.netWrite(c.writeBuf[:2])
 		} else {
 			c.writeBuf[1] = byte(len(reason) + 2)
 			byteOrder.PutUint16(c.writeBuf[2:4], uint16(statusCode))
 			copy(c.writeBuf[4:], reason)
-			c.Conn.Write(c.writeBuf[:4+len(reason)])
+			c.netWrite(c.writeBuf[:4+len(reason)])
+		}
+		c.releaseWriteBuf()
+		if c.HalfDuplex {
+			c.duplexMutex.Unlock()
 		}
 	}
 	c.writeMutex.Unlock()
+}
 
-	return ClosedError(statusCode)
+// CloseNow tears down the connection without any Close frame, as opposed to
+// SendClose. The peer sees an abnormal closure, status code 1006. CloseNow does
+// not wait for any pending write, and it may be invoked simultaneously with any
+// other method from Conn.
+func (c *Conn) CloseNow() error {
+	c.setClose(AbnormalClose, "")
+	return c.Conn.Close()
 }
 
 // Send is a high-level abstraction for safety and convenience.
-// The opcode must be in range [1, 15] like Text, Binary or Ping.
+// The opcode must be in range [1, 15] like Text, Binary or Ping. Opcodes out of
+// range are rejected with ErrOpcodeRange, without any effect on the connection.
+// So is Text with an illegal UTF-8 sequence, rejected with ErrUTF8, when
+// ValidateOutgoingText is set.
 // WireTimeout limits the frame transmission time. On expiry, the connection
 // is closed with status code 1008 [Policy].
-// All error returns are fatal to the connection.
+// All other error returns are fatal to the connection.
 //
 // Multiple goroutines may invoke Send simultaneously. Send may be invoked
 // simultaneously with any other high-level method from Conn. Note that when
 // Send interrupts SendStream, then the opcode of Send is further reduced to
-// range [8, 15]. Simultaneous invokation of any of the low-level net.Conn
-// methods can currupt the connection state.
+// range [8, 15]. Data messages are rejected with ErrStreamBusy in such case.
+// Control frames can only go in between the frames of a stream, as frames
+// can't overlap on the wire. Send waits for any frame in transmission, which
+// includes a stream Write stalled on a slow network, up to the wireTimeout of
+// that Write. Use a short wireTimeout on SendStream, or a small StreamCoalesce,
+// to bound the latency of keepalive pings during large transfers.
+// Send fails with ErrRetry, without any effect, while a frame from a low-level
+// Write is pending on retry.
+// Simultaneous invokation of any of the low-level net.Conn methods can currupt
+// the connection state.
 func (c *Conn) Send(opcode uint, message []byte, wireTimeout time.Duration) error {
+	if opcode == Continuation || opcode > opcodeMask {
+		return ErrOpcodeRange
+	}
+	if opcode == Text && c.ValidateOutgoingText && !utf8.Valid(message) {
+		return ErrUTF8
+	}
+
 	c.writeMutex.Lock()
+	if c.writeStream && opcode&ctrlFlag == 0 {
+		c.writeMutex.Unlock()
+		return ErrStreamBusy
+	}
 	c.SetWriteMode(opcode, true)
 	_, err := c.writeWithRetry(message, wireTimeout)
 	c.writeMutex.Unlock()
 	return err
 }
 
+// ValidBuffers returns whether the concatenation of bufs is valid UTF-8, without
+// any copy. Runes may be split over buffers.
+func validBuffers(bufs net.Buffers) bool {
+	var partial [utf8.UTFMax]byte
+	var partialN int
+	for _, p := range bufs {
+		// complete partial rune from previous buffer
+		for partialN != 0 && len(p) != 0 {
+			partial[partialN] = p[0]
+			partialN++
+			p = p[1:]
+
+			if utf8.FullRune(partial[:partialN]) {
+				r, size := utf8.DecodeRune(partial[:partialN])
+				if r == utf8.RuneError && size == 1 {
+					return false
+				}
+				partialN = 0
+			}
+		}
+
+		// exclude partial rune at the end
+		end := len(p)
+		for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(p[i]) {
+				if !utf8.FullRune(p[i:]) {
+					end = i
+				}
+				break
+			}
+		}
+		if !utf8.Valid(p[:end]) {
+			return false
+		}
+		partialN += copy(partial[partialN:], p[end:])
+	}
+	return partialN == 0
+}
+
+// SendBuffers is like Send, with the message as the concatenation of bufs. The
+// frame header and bufs go out with one vectored write, when available, which
+// saves a copy for messages assembled from multiple parts.
+func (c *Conn) SendBuffers(opcode uint, bufs net.Buffers, wireTimeout time.Duration) error {
+	if opcode == Continuation || opcode > opcodeMask {
+		return ErrOpcodeRange
+	}
+	if opcode == Text && c.ValidateOutgoingText && !validBuffers(bufs) {
+		return ErrUTF8
+	}
+
+	var size int
+	for _, b := range bufs {
+		size += len(b)
+	}
+
+	// encode header
+	var head [10]byte
+	head[0] = byte(opcode | finalFlag)
+	var headN int
+	if size < 126 {
+		head[1] = byte(size)
+		headN = 2
+	} else if size < 1<<16 {
+		head[1] = 126
+		byteOrder.PutUint16(head[2:4], uint16(size))
+		headN = 4
+	} else {
+		head[1] = 127
+		byteOrder.PutUint64(head[2:10], uint64(size))
+		headN = 10
+	}
+	frame := append(make(net.Buffers, 0, 1+len(bufs)), head[:headN])
+	frame = append(frame, bufs...)
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.writeStream && opcode&ctrlFlag == 0 {
+		return ErrStreamBusy
+	}
+	if err := c.closeError(); err != nil {
+		return err
+	}
+	if c.writeBufN > 0 || c.writePayloadN > 0 {
+		// pending frame from Write
+		return ErrRetry
+	}
+	c.countWriteFrame(opcode | finalFlag)
+
+	var retryDelay, retryTotal = time.Microsecond, time.Duration(0)
+	c.Conn.SetWriteDeadline(c.writeDeadline(wireTimeout))
+	if c.HalfDuplex {
+		c.duplexMutex.Lock()
+		defer c.duplexMutex.Unlock()
+	}
+	var w io.Writer = c.Conn
+	if c.FrameTap != nil {
+		// vectored write lost
+		w = tapWriter{c.Conn, c.FrameTap}
+	}
+	for {
+		n, err := frame.WriteTo(w)
+		atomic.AddUint64(&c.writeByteN, uint64(n))
+		if err == nil {
+			return nil
+		}
+
+		e, ok := err.(net.Error)
+		if ok && e.Timeout() {
+			c.setClose(Policy, "write timeout")
+			return err
+		}
+		if !ok || !e.Temporary() {
+			return err
+		}
+
+		if retryTotal += retryDelay; retryTotal > c.retryLimit() {
+			c.setClose(AbnormalClose, "write retry limit")
+			return err
+		}
+		time.Sleep(retryDelay)
+		if retryDelay < time.Second {
+			retryDelay *= 2
+		}
+	}
+}
+
+// WriteText sends s as a Text message with the WriteTimeout from c. Errors are
+// like those from Send.
+func (c *Conn) WriteText(s string) error {
+	return c.Send(Text, []byte(s), fieldTimeout(c.WriteTimeout))
+}
+
+// WriteBinary sends p as a Binary message with the WriteTimeout from c. Errors
+// are like those from Send.
+func (c *Conn) WriteBinary(p []byte) error {
+	return c.Send(Binary, p, fieldTimeout(c.WriteTimeout))
+}
+
 // SendStream is an alternative to Send.
-// The opcode must be in range [1, 7] like Text or Binary.
+// The opcode must be in range [1, 7] like Text or Binary. SendStream panics on
+// opcodes out of range, like SetWriteMode does.
 // WireTimeout limits the frame transmission time. On expiry, the connection
 // is closed with status code 1008 [Policy].
-// All errors from the io.WriteCloser other than io.ErrClosedPipe are fatal to
-// the connection. Check Close for errors too!
+// All errors from the io.WriteCloser other than io.ErrClosedPipe and
+// ErrWriteMode are fatal to the connection. Check Close for errors too!
 //
 // The stream must be closed before any other invocation to SendStream is made
-// and Send may only interrupt with control frames—opcode range [8, 15].
+// and Send may only interrupt with control frames—opcode range [8, 15]. Until
+// then, the io.WriteCloser from any other SendStream fails with ErrStreamBusy.
+// Each Write holds the connection for the duration of its frame transmission,
+// which delays any such control frame. Large writes are best split up when
+// timely pings matter.
 // Multiple goroutines may invoke the io.WriteCloser methods simultaneously.
 // Simultaneous invokation of either SendStream or the io.WriteCloser with any
 // of the low-level net.Conn methods can currupt the connection state.
+//
+// WebSocket has no means to abort a message other than to close the connection.
+// The io.WriteCloser has an Abort(statusCode uint, reason string) error method
+// for this purpose, which does a SendClose without completing the message.
+// Writes after Abort fail with io.ErrClosedPipe. The message stays incomplete,
+// and so SendStream and Send with data remain rejected with ErrStreamBusy.
+//
+// The io.WriteCloser also has a BytesSent() int64 method, for progress reports.
+// It returns the number of payload bytes written thus far, which includes any
+// bytes pending conform StreamCoalesce. Each stream counts from zero.
+//
+// With StreamBufferSize set, each Write copies p into a queue, and a goroutine
+// transmits the queue in the background, in order of the writes. Write accepts
+// as much of p as the queue can hold, and it returns ErrWouldBlock when that is
+// less than len(p). Errors from the transmission fail the next Write or Close.
+// Close waits for the queue to drain before it sends the final frame. Abort
+// discards the queue. BytesSent excludes any bytes still queued.
 func (c *Conn) SendStream(opcode uint, wireTimeout time.Duration) io.WriteCloser {
-	c.SetWriteMode(opcode, false)
+	if opcode == Continuation {
+		// setStreamMode accepts continuation for the follow-up frames
+		panic("websocket: send stream with continuation opcode")
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.writeStream {
+		return busyWriter{}
+	}
+	c.setStreamMode(opcode, false)
+	c.writeStream = true
+	if c.CorkStreams {
+		setCork(c.NetConn(), true)
+	}
+
+	var w streamWriter
 	switch opcode {
 	default:
-		return &messageWriter{c, wireTimeout, opcode}
+		w = &messageWriter{conn: c, wireTimeout: wireTimeout, opcode: opcode}
 	case Text:
-		return &textWriter{conn: c, wireTimeout: wireTimeout, opcode: opcode}
+		w = &textWriter{conn: c, wireTimeout: wireTimeout, opcode: opcode}
+	}
+	if c.StreamBufferSize > 0 {
+		q := &queueWriter{w: w, size: c.StreamBufferSize}
+		q.drained.L = &q.mutex
+		return q
 	}
+	return w
 }
 
+// StreamWriter is the io.WriteCloser from SendStream.
+type streamWriter interface {
+	io.WriteCloser
+	Abort(statusCode uint, reason string) error
+	BytesSent() int64
+}
+
+// CopyBufPool holds buffers for ReadFrom and WriteTo on streams.
+var copyBufPool = sync.Pool{
+	New: func() interface{} { return new([32 * 1024]byte) },
+}
+
+// CopyWithPool does an io.Copy with a pooled buffer, one Write per Read.
+func copyWithPool(w io.Writer, r io.Reader) (n int64, err error) {
+	buf := copyBufPool.Get().(*[32 * 1024]byte)
+	defer copyBufPool.Put(buf)
+
+	for {
+		readN, readErr := r.Read(buf[:])
+		if readN != 0 {
+			writeN, err := w.Write(buf[:readN])
+			n += int64(writeN)
+			if err != nil {
+				return n, err
+			}
+			if writeN < readN {
+				return n, io.ErrShortWrite
+			}
+		}
+		switch readErr {
+		case nil:
+			continue
+		case io.EOF:
+			return n, nil
+		default:
+			return n, readErr
+		}
+	}
+}
+
+// BusyWriter is the io.WriteCloser from a SendStream rejected by another.
+type busyWriter struct{}
+
+func (busyWriter) Write([]byte) (int, error) { return 0, ErrStreamBusy }
+func (busyWriter) Close() error              { return ErrStreamBusy }
+func (busyWriter) Abort(uint, string) error  { return ErrStreamBusy }
+func (busyWriter) BytesSent() int64          { return 0 }
+
+// QueueWriter transmits writes in the background, conform StreamBufferSize.
+type queueWriter struct {
+	w    streamWriter
+	size int // queue limit
+
+	mutex    sync.Mutex
+	drained  sync.Cond // signals flushing false
+	queue    []byte    // pending writes
+	spare    []byte    // recycled queue
+	err      error     // first transmission failure
+	flushing bool      // goroutine active
+	closed   bool      // Close or Abort invoked
+}
+
+func (w *queueWriter) Write(p []byte) (n int, err error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	switch {
+	case w.err != nil:
+		return 0, w.err
+	case w.closed:
+		return 0, io.ErrClosedPipe
+	}
+
+	n = w.size - len(w.queue)
+	if n >= len(p) {
+		n = len(p)
+	} else {
+		err = ErrWouldBlock
+	}
+	w.queue = append(w.queue, p[:n]...)
+
+	if !w.flushing && len(w.queue) != 0 {
+		w.flushing = true
+		go w.flush()
+	}
+	return n, err
+}
+
+// Flush transmits the queue until it is empty.
+func (w *queueWriter) flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for len(w.queue) != 0 && w.err == nil && !w.closed {
+		p := w.queue
+		w.queue = w.spare[:0]
+		w.mutex.Unlock()
+		_, err := w.w.Write(p)
+		w.mutex.Lock()
+		w.spare = p
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+	w.flushing = false
+	w.drained.Broadcast()
+}
+
+func (w *queueWriter) Close() error {
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return nil
+	}
+	w.closed = true
+	// flush stops at closed
+	for w.flushing {
+		w.drained.Wait()
+	}
+	if len(w.queue) != 0 && w.err == nil {
+		p := w.queue
+		w.queue = nil
+		w.mutex.Unlock()
+		_, err := w.w.Write(p)
+		w.mutex.Lock()
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+	}
+	err := w.err
+	w.mutex.Unlock()
+
+	// release the stream, even after failure
+	closeErr := w.w.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Abort closes the connection with the message incomplete. The queue is
+// discarded.
+func (w *queueWriter) Abort(statusCode uint, reason string) error {
+	w.mutex.Lock()
+	w.closed = true
+	w.queue = nil
+	w.mutex.Unlock()
+
+	return w.w.Abort(statusCode, reason)
+}
+
+// BytesSent returns the number of payload bytes written, excluding the queue.
+func (w *queueWriter) BytesSent() int64 { return w.w.BytesSent() }
+
 type messageWriter struct {
+	sent        int64 // atomic; first for alignment
 	conn        *Conn
 	wireTimeout time.Duration
 	opcode      uint
@@ -195,28 +626,42 @@ func (w *messageWriter) Write(p []byte) (n int, err error) {
 	if w.opcode == Close {
 		err = io.ErrClosedPipe
 	} else {
-		w.conn.SetWriteMode(w.opcode, false)
-		w.opcode = Continuation
-		n, err = w.conn.writeWithRetry(p, w.wireTimeout)
+		n, err = w.conn.writeFragment(&w.opcode, p, w.wireTimeout)
+		atomic.AddInt64(&w.sent, int64(n))
 	}
 	w.conn.writeMutex.Unlock()
 
 	return
 }
 
-func (w messageWriter) Close() (err error) {
+// BytesSent returns the number of payload bytes written.
+func (w *messageWriter) BytesSent() int64 { return atomic.LoadInt64(&w.sent) }
+
+// ReadFrom implements io.ReaderFrom with a frame per Read from r.
+func (w *messageWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	return copyWithPool(w, r)
+}
+
+func (w *messageWriter) Close() (err error) {
 	w.conn.writeMutex.Lock()
 	if w.opcode != Close {
-		w.conn.SetWriteMode(w.opcode, true)
-		w.opcode = Close
-		_, err = w.conn.writeWithRetry(nil, w.wireTimeout)
+		err = w.conn.writeFinal(w.opcode, w.wireTimeout)
+		if err != ErrWriteMode {
+			w.opcode = Close
+		}
 	}
 	w.conn.writeMutex.Unlock()
 
 	return
 }
 
+// Abort closes the connection with the message incomplete.
+func (w *messageWriter) Abort(statusCode uint, reason string) error {
+	return w.conn.abortStream(&w.opcode, statusCode, reason)
+}
+
 type textWriter struct {
+	sent        int64 // atomic; first for alignment
 	conn        *Conn
 	wireTimeout time.Duration
 	opcode      uint
@@ -224,82 +669,204 @@ type textWriter struct {
 	remainN     int
 }
 
+// BytesSent returns the number of payload bytes written.
+func (w *textWriter) BytesSent() int64 { return atomic.LoadInt64(&w.sent) }
+
 func (w *textWriter) Write(p []byte) (n int, err error) {
 	w.conn.writeMutex.Lock()
+	defer w.conn.writeMutex.Unlock()
 
 	if w.opcode == Close {
-		w.conn.writeMutex.Unlock()
 		return 0, io.ErrClosedPipe
 	}
 
-	// complete partial UTF-8 sequence if there's any
+	// complete partial rune from previous write
 	for w.remainN != 0 {
 		if n >= len(p) {
-			return // consumed entire payload
+			atomic.AddInt64(&w.sent, int64(n))
+			return n, nil // consumed entire payload
 		}
-
-		// add one byte
 		w.remain[w.remainN] = p[n]
 		w.remainN++
 		n++
 
-		r, _ := utf8.DecodeRune(w.remain[:w.remainN])
-		if r != utf8.RuneError {
-			p = append(w.remain[:w.remainN], p...)
-			n -= w.remainN // makes n negative
+		if utf8.FullRune(w.remain[:w.remainN]) {
+			r, size := utf8.DecodeRune(w.remain[:w.remainN])
+			if r == utf8.RuneError && size == 1 {
+				return n, ErrUTF8
+			}
+			// goes out with the next fragment
+			w.conn.streamBuf = append(w.conn.streamBuf, w.remain[:w.remainN]...)
 			w.remainN = 0
-		} else if w.remainN >= utf8.UTFMax {
-			return n, errUTF8
 		}
 	}
+	p = p[n:]
 
-	// determine last complete rune end
+	// exclude partial rune at the end
 	end := len(p)
-	if !utf8.Valid(p) {
-		for end--; end >= 0; end-- {
-			if p[end]&0xc0 != 0xc0 {
-				break // multi-byte start
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
 			}
+			break
 		}
+	}
+	if !utf8.Valid(p[:end]) {
+		return n, ErrUTF8
+	}
 
-		if end < len(p)-utf8.UTFMax || !utf8.Valid(p[:end]) {
-			return n, errUTF8
+	if end != 0 {
+		done, err := w.conn.writeFragment(&w.opcode, p[:end], w.wireTimeout)
+		n += done
+		if err != nil {
+			atomic.AddInt64(&w.sent, int64(n))
+			return n, err
 		}
 	}
+	w.remainN = copy(w.remain[:], p[end:])
+	n += w.remainN
+	atomic.AddInt64(&w.sent, int64(n))
+	return n, nil
+}
+
+// ReadFrom implements io.ReaderFrom with a frame per Read from r.
+func (w *textWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	return copyWithPool(w, r)
+}
 
-	w.conn.SetWriteMode(w.opcode, false)
-	w.opcode = Continuation
+func (w *textWriter) Close() (err error) {
+	w.conn.writeMutex.Lock()
+	if w.remainN != 0 {
+		err = ErrUTF8
+	} else if w.opcode != Close {
+		err = w.conn.writeFinal(w.opcode, w.wireTimeout)
+		if err != ErrWriteMode {
+			w.opcode = Close
+		}
+	}
+	w.conn.writeMutex.Unlock()
 
-	done, err := w.conn.writeWithRetry(p, w.wireTimeout)
-	n += done
+	return
+}
 
-	w.remainN = copy(w.remain[:], p[end:])
+// Abort closes the connection with the message incomplete.
+func (w *textWriter) Abort(statusCode uint, reason string) error {
+	return w.conn.abortStream(&w.opcode, statusCode, reason)
+}
 
-	w.conn.writeMutex.Unlock()
+// AbortStream sends a Close, without the final frame of the SendStream. The
+// opcode is set to Close, which fails any further use of the stream. A stream
+// which was closed already leaves the connection as is.
+func (c *Conn) abortStream(opcode *uint, statusCode uint, reason string) error {
+	c.writeMutex.Lock()
+	if *opcode == Close {
+		c.writeMutex.Unlock()
+		return io.ErrClosedPipe
+	}
+	*opcode = Close
+	// writeStream remains set; data frames can't follow the partial message
+	c.streamBuf = c.streamBuf[:0]
+	if c.CorkStreams {
+		setCork(c.NetConn(), false)
+	}
+	c.writeMutex.Unlock()
+
+	return c.SendClose(statusCode, reason)
+}
+
+// WriteFragment sends p as a non-final frame of the SendStream, or it buffers p
+// conform StreamCoalesce. The opcode is set to Continuation once a frame is
+// send. The caller must hold the writeMutex lock.
+func (c *Conn) writeFragment(opcode *uint, p []byte, timeout time.Duration) (n int, err error) {
+	if len(c.streamBuf)+len(p) < c.StreamCoalesce {
+		c.streamBuf = append(c.streamBuf, p...)
+		return len(p), nil
+	}
+
+	c.setStreamMode(*opcode, false)
+	if len(c.streamBuf) == 0 {
+		n, err = c.writeWithRetry(p, timeout)
+		if err != ErrWriteMode {
+			*opcode = Continuation
+		}
+		return n, err
+	}
+
+	// one frame with the buffer
+	bufN := len(c.streamBuf)
+	c.streamBuf = append(c.streamBuf, p...)
+	n, err = c.writeWithRetry(c.streamBuf, timeout)
+	if err == ErrWriteMode {
+		// buffer remains for retry
+		c.streamBuf = c.streamBuf[:bufN]
+		return 0, err
+	}
+	*opcode = Continuation
+	if cap(c.streamBuf) > 2*c.StreamCoalesce {
+		c.streamBuf = nil // don't retain large writes
+	} else {
+		c.streamBuf = c.streamBuf[:0]
+	}
+	if n -= bufN; n < 0 {
+		n = 0
+	}
 	return n, err
 }
 
-func (w textWriter) Close() (err error) {
-	if w.remainN != 0 {
-		return errUTF8
+// WriteFinal sends the final frame of the SendStream, including any buffered
+// payload. The caller must hold the writeMutex lock.
+func (c *Conn) writeFinal(opcode uint, timeout time.Duration) error {
+	c.setStreamMode(opcode, true)
+	_, err := c.writeWithRetry(c.streamBuf, timeout)
+	if err == ErrWriteMode {
+		return err // stream remains
+	}
+	c.writeStream = false
+	c.streamBuf = c.streamBuf[:0]
+	if c.CorkStreams {
+		setCork(c.NetConn(), false)
 	}
+	return err
+}
 
-	w.conn.writeMutex.Lock()
-	if w.opcode != Close {
-		w.conn.SetWriteMode(w.opcode, true)
-		w.opcode = Close
-		_, err = w.conn.writeWithRetry(nil, w.wireTimeout)
+// SetStreamMode does a SetWriteMode for the SendStream, with the frame header
+// recorded for verification by writeFrame. It panics like SetWriteMode does.
+// The caller must hold the writeMutex lock.
+func (c *Conn) setStreamMode(opcode uint, final bool) {
+	if opcode > opcodeMask {
+		panic(fmt.Sprintf("websocket: opcode %d out of range [0, 15]", opcode))
+	}
+	if !final && opcode&ctrlFlag != 0 {
+		panic(fmt.Sprintf("websocket: control frame opcode %d not final", opcode))
 	}
-	w.conn.writeMutex.Unlock()
 
-	return
+	head := opcode
+	if final {
+		head |= finalFlag
+	}
+	c.streamHead = uint32(head)
+	atomic.StoreUint32(&c.writeHead, uint32(head))
+}
+
+// RetryLimit returns the effective RetryLimit.
+func (c *Conn) retryLimit() time.Duration {
+	if c.RetryLimit == 0 {
+		return 10 * time.Second
+	}
+	return c.RetryLimit
 }
 
 // caller must hold the writeMutex lock
 func (c *Conn) writeWithRetry(p []byte, timeout time.Duration) (n int, err error) {
-	var retryDelay = time.Microsecond
+	if c.writeBufN > 0 || c.writePayloadN > 0 {
+		// pending frame from Write; payload must not mix in
+		return 0, ErrRetry
+	}
+
+	var retryDelay, retryTotal = time.Microsecond, time.Duration(0)
 
-	c.SetWriteDeadline(time.Now().Add(timeout))
+	c.Conn.SetWriteDeadline(c.writeDeadline(timeout))
 	n, err = c.write(p)
 	for err != nil {
 		e, ok := err.(net.Error)
@@ -311,6 +878,10 @@ func (c *Conn) writeWithRetry(p []byte, timeout time.Duration) (n int, err error
 			return
 		}
 
+		if retryTotal += retryDelay; retryTotal > c.retryLimit() {
+			c.setClose(AbnormalClose, "write retry limit")
+			return
+		}
 		time.Sleep(retryDelay)
 		if retryDelay < time.Second {
 			retryDelay *= 2
@@ -333,38 +904,285 @@ func (c *Conn) writeWithRetry(p []byte, timeout time.Duration) (n int, err error
 // may cause protocol violations.
 //
 // WireTimeout is the limit for Read [frame receival] and idleTimeout limits
-// the amount of time to wait for arrival.
+// the amount of time to wait for arrival. On expiry, the connection is closed
+// with status code 1008 [Policy], and the error return is a ClosedError. The
+// same applies to the stream from ReceiveStream.
+//
+// A Close from the peer comes as a ClosedError with the status code received.
+// When the peer ends the connection without any Close, then Receive returns
+// io.EOF in between messages, and io.ErrUnexpectedEOF halfway a message. The
+// status code is 1006 [AbnormalClose] in both cases, as seen with Stats.
 func (c *Conn) Receive(buf []byte, wireTimeout, idleTimeout time.Duration) (opcode uint, n int, err error) {
-	n, opcode, final, err := c.readWithRetry(buf, idleTimeout)
+	n, opcode, final, err := c.readWithRetry(buf, idleTimeout, nil, false)
 	if err != nil {
 		return opcode, n, err
 	}
 	if opcode == Continuation {
-		return opcode, n, c.SendClose(ProtocolError, "anonymous continuation")
+		return opcode, n, c.sendClose(ProtocolError, "anonymous continuation", causeContinuation)
 	}
 
+	n, err = c.receiveRemainder(buf, n, opcode, final, wireTimeout)
+	return opcode, n, err
+}
+
+// ReadMessage receives a message with the WireTimeout and IdleTimeout from c.
+// The zero value of either field disables its limit. Errors are like those from
+// Receive.
+func (c *Conn) ReadMessage(buf []byte) (opcode uint, n int, err error) {
+	return c.Receive(buf, fieldTimeout(c.WireTimeout), fieldTimeout(c.IdleTimeout))
+}
+
+// ReceiveRemainder completes a message in buf, with the first n bytes done.
+func (c *Conn) receiveRemainder(buf []byte, n int, opcode uint, final bool, wireTimeout time.Duration) (int, error) {
 	for !final {
 		if n >= len(buf) {
 			c.SendClose(TooBig, "")
-			return opcode, n, ErrOverflow
+			return n, ErrOverflow
 		}
 
-		more, opcode, moreFinal, err := c.readWithRetry(buf[n:], wireTimeout)
+		more, opcode, moreFinal, err := c.readWithRetry(buf[n:], wireTimeout, nil, false)
 		if opcode != Continuation { // also valid when err != nil
-			return opcode, n, c.SendClose(ProtocolError, "fragmented message interrupted")
+			return n, c.sendClose(ProtocolError, "fragmented message interrupted", causeInterrupted)
 		}
 		n += more
 		if err != nil {
-			return opcode, n, err
+			return n, err
 		}
 		final = moreFinal
 	}
 
 	if opcode == Text && !utf8.Valid(buf[:n]) {
-		return opcode, n, errUTF8
+		return n, ErrUTF8
+	}
+
+	return n, nil
+}
+
+// ReceiveBuffer is an alternative to Receive, which appends the message to buf.
+// The buffer grows as needed, up to max bytes of message. Messages which exceed
+// max are rejected with ErrOverflow, after a connection Close with status code
+// 1009 [TooBig]. The opcode return is in range [1, 7]. Control frames are dealed
+// with.
+//
+// WireTimeout is the limit for Read [frame receival] and idleTimeout limits
+// the amount of time to wait for arrival.
+func (c *Conn) ReceiveBuffer(buf *bytes.Buffer, max int, wireTimeout, idleTimeout time.Duration) (opcode uint, err error) {
+	opcode, r, err := c.ReceiveStream(wireTimeout, idleTimeout)
+	if err != nil {
+		return opcode, err
+	}
+
+	n, err := buf.ReadFrom(io.LimitReader(r, overflowLimit(int64(max))))
+	if err != nil {
+		return opcode, err
+	}
+	if n > int64(max) {
+		buf.Truncate(buf.Len() - 1)
+		c.SendClose(TooBig, "")
+		return opcode, ErrOverflow
+	}
+	return opcode, nil
+}
+
+// OverflowLimit returns max plus one, as one byte extra detects overflow. The
+// limit stays at max when max is the maximum already.
+func overflowLimit(max int64) int64 {
+	if max < math.MaxInt64 {
+		return max + 1
+	}
+	return max
+}
+
+// ReceivePooled is like ReceiveBuffer, with a buffer from MessageBufferPool, or
+// with a new buffer when the pool is nil or empty. The buffer is owned by the
+// caller until ReleaseBuffer. The buffer return is nil on error.
+func (c *Conn) ReceivePooled(max int, wireTimeout, idleTimeout time.Duration) (opcode uint, buf *bytes.Buffer, err error) {
+	buf = c.acquireBuffer()
+	opcode, err = c.ReceiveBuffer(buf, max, wireTimeout, idleTimeout)
+	if err != nil {
+		c.ReleaseBuffer(buf)
+		return opcode, nil, err
+	}
+	return opcode, buf, nil
+}
+
+// ReleaseBuffer returns buf to the MessageBufferPool, if any. Neither buf nor
+// any slice from buf may be used after the release.
+func (c *Conn) ReleaseBuffer(buf *bytes.Buffer) {
+	if c.MessageBufferPool != nil {
+		buf.Reset()
+		c.MessageBufferPool.Put(buf)
+	}
+}
+
+// AcquireBuffer returns an empty buffer from MessageBufferPool, if any.
+func (c *Conn) acquireBuffer() *bytes.Buffer {
+	if c.MessageBufferPool != nil {
+		if v := c.MessageBufferPool.Get(); v != nil {
+			return v.(*bytes.Buffer)
+		}
+	}
+	return new(bytes.Buffer)
+}
+
+// ReceiveInPlace is an alternative to Receive which prevents a copy for small
+// messages. When a message arrived in one frame, and the frame is buffered in
+// full, then the payload return is a slice of the internal read buffer. Such
+// payload stays valid until the next read from the connection only. Otherwise,
+// ReceiveInPlace reads the message into buf, like Receive does. The opcode
+// return is in range [1, 7]. Control frames are dealed with.
+//
+// WireTimeout is the limit for Read [frame receival] and idleTimeout limits
+// the amount of time to wait for arrival.
+func (c *Conn) ReceiveInPlace(buf []byte, wireTimeout, idleTimeout time.Duration) (opcode uint, payload []byte, err error) {
+	if err := c.nextDataFrame(idleTimeout); err != nil {
+		return 0, nil, err
+	}
+
+	c.readMutex.Lock()
+	head := uint(atomic.LoadUint32(&c.readHead))
+	if head&readPeekFlag != 0 {
+		// header consumed here
+		atomic.StoreUint32(&c.readHead, uint32(head&^readPeekFlag))
+	}
+	opcode = head & opcodeMask
+	if opcode == Continuation {
+		c.readMutex.Unlock()
+		return opcode, nil, c.sendClose(ProtocolError, "anonymous continuation", causeContinuation)
+	}
+
+	if head&finalFlag != 0 && c.readPayloadN <= c.readBufN-c.readBufDone {
+		// frame buffered in full
+		payload = c.readBuf[c.readBufDone : c.readBufDone+c.readPayloadN]
+		c.unmaskN(payload)
+		c.readBufDone += c.readPayloadN
+		c.readPayloadN = 0
+		c.readPending()
+		c.readMutex.Unlock()
+
+		if opcode == Text && !utf8.Valid(payload) {
+			return opcode, payload, ErrUTF8
+		}
+		return opcode, payload, nil
+	}
+	c.readMutex.Unlock()
+
+	// copy remainder of first frame
+	var n int
+	final := head&finalFlag != 0
+	for c.readPayloadN != 0 && n < len(buf) {
+		more, _, moreFinal, err := c.readWithRetry(buf[n:], wireTimeout, nil, false)
+		n += more
+		if err != nil {
+			return opcode, buf[:n], err
+		}
+		final = moreFinal
 	}
+	if c.readPayloadN != 0 {
+		final = false
+	}
+
+	n, err = c.receiveRemainder(buf, n, opcode, final, wireTimeout)
+	return opcode, buf[:n], err
+}
 
-	return opcode, n, nil
+// ReadFrameInto reads the payload of the next data frame into p, without any
+// message reassembly. The opcode return is Continuation for all but the first
+// frame of a fragmented message. Final marks the last frame of a message.
+// Control frames are dealed with, i.e., they are handled internally and then
+// skipped. Text payloads are not validated as frames may split a character.
+//
+// ErrOverflow rejects a frame with a payload larger than p. The frame remains
+// available in full, such that ReadFrameInto can retry with a larger buffer.
+// The opcode and final returns are set on ErrOverflow.
+//
+// WireTimeout is the limit for payload receival and idleTimeout limits the
+// amount of time to wait for arrival.
+func (c *Conn) ReadFrameInto(p []byte, wireTimeout, idleTimeout time.Duration) (opcode uint, final bool, n int, err error) {
+	if err := c.nextDataFrame(idleTimeout); err != nil {
+		return 0, false, 0, err
+	}
+
+	c.readMutex.Lock()
+	head := uint(atomic.LoadUint32(&c.readHead))
+	opcode, final = head&opcodeMask, head&finalFlag != 0
+	if c.readPayloadN > len(p) {
+		// header remains for retry
+		atomic.StoreUint32(&c.readHead, uint32(head|readPeekFlag))
+		c.readMutex.Unlock()
+		return opcode, final, 0, ErrOverflow
+	}
+	// header consumed here
+	atomic.StoreUint32(&c.readHead, uint32(head&^readPeekFlag))
+	c.readMutex.Unlock()
+
+	for c.readPayloadN != 0 {
+		more, _, _, err := c.readWithRetry(p[n:], wireTimeout, nil, false)
+		n += more
+		if err != nil {
+			return opcode, final, n, err
+		}
+	}
+	return opcode, final, n, nil
+}
+
+// PeekMessage returns up to n bytes from the payload of the next message, while
+// the message remains available in full for the next receive or Read. The peek
+// is limited to the first frame of the message, and to 125 bytes. Repeated use
+// of PeekMessage returns the same message. Control frames are dealed with.
+// PeekMessage must not be called while a message is received partially.
+//
+// IdleTimeout limits the amount of time to wait for arrival.
+func (c *Conn) PeekMessage(n int, idleTimeout time.Duration) ([]byte, error) {
+	if err := c.nextDataFrame(idleTimeout); err != nil {
+		return nil, err
+	}
+
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	head := atomic.LoadUint32(&c.readHead)
+	if head&opcodeMask == Continuation {
+		return nil, c.sendClose(ProtocolError, "anonymous continuation", causeContinuation)
+	}
+	atomic.StoreUint32(&c.readHead, head|readPeekFlag)
+
+	if n > c.readPayloadN {
+		n = c.readPayloadN
+	}
+	if n > 125 {
+		n = 125
+	}
+	if c.readBufDone+n > len(c.readBuf) {
+		// move payload to beginning of buffer
+		c.readBufN = copy(c.readBuf[:], c.readBuf[c.readBufDone:c.readBufN])
+		c.readBufDone = 0
+	}
+	if err := c.ensureBufN(c.readBufDone + n); err != nil {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			err = c.readTimeout()
+		}
+		return nil, err
+	}
+
+	// unmask a copy; mask state remains
+	p := make([]byte, n)
+	copy(p, c.readBuf[c.readBufDone:])
+	maskWith(p, c.mask, c.maskI)
+	return p, nil
+}
+
+// NextMessageIsText returns whether the next message is Text, while the message
+// remains available in full for the next receive or Read. Only the header of the
+// first frame is read, conform PeekMessage. Control frames are dealed with.
+//
+// IdleTimeout limits the amount of time to wait for arrival.
+func (c *Conn) NextMessageIsText(idleTimeout time.Duration) (bool, error) {
+	if _, err := c.PeekMessage(0, idleTimeout); err != nil {
+		return false, err
+	}
+	opcode, _ := c.ReadMode()
+	return opcode == Text, nil
 }
 
 // ReceiveStream is a high-level abstraction (from Read) for safety and
@@ -373,36 +1191,114 @@ func (c *Conn) Receive(buf []byte, wireTimeout, idleTimeout time.Duration) (opco
 //
 // Receive must be called sequentially. Reader must be fully consumed before
 // the next call to Receive. Interruptions from other calls to Receive or Read
-// may cause protocol violations.
+// may cause protocol violations. The Reader is reused by the next call to
+// ReceiveStream, so it must not be retained.
 //
 // WireTimeout is the limit for Read [frame receival] and idleTimeout limits
-// the amount of time to wait for arrival.
+// the amount of time to wait for arrival. Expiry of wireTimeout closes the
+// connection, unless StreamTimeoutRecoverable is set. A Close from the peer,
+// halfway a message, fails the Reader with a ClosedError with the status code
+// received, like Receive does.
 func (c *Conn) ReceiveStream(wireTimeout, idleTimeout time.Duration) (opcode uint, r io.Reader, err error) {
-	_, opcode, final, err := c.readWithRetry(nil, idleTimeout)
+	_, opcode, final, err := c.readWithRetry(nil, idleTimeout, nil, false)
 	if err != nil {
 		return 0, nil, err
 	}
 	if opcode == Continuation {
-		return 0, nil, c.SendClose(ProtocolError, "anonymous continuation")
+		return 0, nil, c.sendClose(ProtocolError, "anonymous continuation", causeContinuation)
 	}
 
+	// readers are reused to prevent allocation per message
 	switch {
 	case final:
 		r = readEOF{}
 	case opcode == Text:
-		r = &textReader{
+		c.textReader = textReader{
 			conn:        c,
 			wireTimeout: wireTimeout,
 		}
+		r = &c.textReader
 	default:
-		r = &messageReader{
+		c.messageReader = messageReader{
 			conn:        c,
 			wireTimeout: wireTimeout,
 		}
+		r = &c.messageReader
 	}
 	return opcode, r, nil
 }
 
+// HandleText installs f for the Text messages from ServeMessages. A nil f, the
+// default, discards Text messages. HandleText must not be invoked while
+// ServeMessages is in progress.
+func (c *Conn) HandleText(f func(message string) error) {
+	c.textHandler = f
+}
+
+// HandleBinary installs f for the Binary messages from ServeMessages. The slice
+// is valid for the duration of the call only. A nil f, the default, discards
+// Binary messages. HandleBinary must not be invoked while ServeMessages is in
+// progress.
+func (c *Conn) HandleBinary(f func(message []byte) error) {
+	c.binaryHandler = f
+}
+
+// ServeMessages is a push-style alternative to ReceiveBuffer. Each message is
+// passed to the handler from either HandleText or HandleBinary, in order of
+// arrival. Text is validated as UTF-8 before the handler is called. Messages
+// which exceed max bytes are rejected like ReceiveBuffer does. ServeMessages
+// returns with the first error from either a handler or the connection.
+//
+// WireTimeout is the limit for Read [frame receival] and idleTimeout limits
+// the amount of time to wait for arrival.
+func (c *Conn) ServeMessages(max int, wireTimeout, idleTimeout time.Duration) error {
+	buf := c.acquireBuffer()
+	defer c.ReleaseBuffer(buf)
+	for {
+		buf.Reset()
+		opcode, err := c.ReceiveBuffer(buf, max, wireTimeout, idleTimeout)
+		if err != nil {
+			return err
+		}
+
+		switch opcode {
+		case Text:
+			if c.textHandler != nil {
+				err = c.textHandler(buf.String())
+			}
+		case Binary:
+			if c.binaryHandler != nil {
+				err = c.binaryHandler(buf.Bytes())
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Serve is a push-style alternative to ReceiveStream. Each message is passed to
+// handler, in order of arrival. Any remainder of the io.Reader, i.e., payload
+// not consumed by handler, is discarded. Serve returns with the first error from
+// either handler or the connection.
+//
+// WireTimeout is the limit for Read [frame receival] and idleTimeout limits
+// the amount of time to wait for arrival.
+func (c *Conn) Serve(handler func(opcode uint, r io.Reader) error, wireTimeout, idleTimeout time.Duration) error {
+	for {
+		opcode, r, err := c.ReceiveStream(wireTimeout, idleTimeout)
+		if err != nil {
+			return err
+		}
+		if err := handler(opcode, r); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+	}
+}
+
 type messageReader struct {
 	conn        *Conn
 	wireTimeout time.Duration
@@ -414,9 +1310,9 @@ func (r *messageReader) Read(p []byte) (n int, err error) {
 		return 0, r.err
 	}
 
-	n, opcode, final, err := r.conn.readWithRetry(p, r.wireTimeout)
+	n, opcode, final, err := r.conn.readWithRetry(p, r.wireTimeout, r.conn.StreamCtrlListener, r.conn.StreamTimeoutRecoverable)
 	if opcode != Continuation { // also valid when err != nil
-		return 0, r.conn.SendClose(ProtocolError, "fragmented message interrupted")
+		return 0, r.conn.sendClose(ProtocolError, "fragmented message interrupted", causeInterrupted)
 	}
 	if final {
 		r.err = io.EOF
@@ -427,12 +1323,18 @@ func (r *messageReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// WriteTo implements io.WriterTo with a Write per frame read.
+func (r *messageReader) WriteTo(w io.Writer) (n int64, err error) {
+	return copyWithPool(w, r)
+}
+
 type textReader struct {
 	conn        *Conn
 	wireTimeout time.Duration
 	err         error
-	tail        [utf8.UTFMax - 1]byte
-	tailN       int
+	// partial rune from previous read, pending validation
+	tail  [utf8.UTFMax]byte
+	tailN int
 }
 
 func (r *textReader) Read(p []byte) (n int, err error) {
@@ -440,42 +1342,15 @@ func (r *textReader) Read(p []byte) (n int, err error) {
 		return 0, r.err
 	}
 
-	// start with remainder
-	n = r.tailN
-	for i := range p {
-		if i >= n {
-			break
-		}
-		p[i] = r.tail[i]
-	}
-
-	// actual read
-	more, opcode, final, err := r.conn.readWithRetry(p[n:], r.wireTimeout)
+	n, opcode, final, err := r.conn.readWithRetry(p, r.wireTimeout, r.conn.StreamCtrlListener, r.conn.StreamTimeoutRecoverable)
 	if opcode != Continuation { // also valid when err != nil
-		return n, r.conn.SendClose(ProtocolError, "fragmented message interrupted")
+		return n, r.conn.sendClose(ProtocolError, "fragmented message interrupted", causeInterrupted)
 	}
-	n += more
 
 	// validation overrules I/O errors; received payload shoud be valid
-	if !utf8.Valid(p[:n]) {
-		if final {
-			return n, errUTF8
-		}
-		// last rune might be partial
-
-		end := n
-		for end--; end >= 0; end-- {
-			if p[end]&0xc0 != 0xc0 {
-				break // multi-byte start
-			}
-		}
-
-		if end+utf8.UTFMax >= n || !utf8.Valid(p[:end]) {
-			return n, errUTF8
-		}
-
-		r.tailN = copy(r.tail[:], p[end:])
-		n = end
+	if !r.validate(p[:n]) || final && r.tailN != 0 {
+		r.err = ErrUTF8
+		return n, ErrUTF8
 	}
 
 	if final {
@@ -488,28 +1363,78 @@ func (r *textReader) Read(p []byte) (n int, err error) {
 	return n, err
 }
 
+// WriteTo implements io.WriterTo with a Write per frame read.
+func (r *textReader) WriteTo(w io.Writer) (n int64, err error) {
+	return copyWithPool(w, r)
+}
+
+// Validate checks p as a continuation of any previous reads. A partial rune at
+// the end of p is retained in tail, pending validation with the next read.
+func (r *textReader) validate(p []byte) bool {
+	// complete partial rune from previous read
+	for r.tailN != 0 && len(p) != 0 {
+		r.tail[r.tailN] = p[0]
+		r.tailN++
+		p = p[1:]
+
+		if utf8.FullRune(r.tail[:r.tailN]) {
+			c, size := utf8.DecodeRune(r.tail[:r.tailN])
+			if c == utf8.RuneError && size == 1 {
+				return false
+			}
+			r.tailN = 0
+		}
+	}
+
+	// exclude partial rune at the end
+	end := len(p)
+	for i := len(p) - 1; i >= 0 && i >= len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+
+	if !utf8.Valid(p[:end]) {
+		return false
+	}
+	r.tailN += copy(r.tail[r.tailN:], p[end:])
+	return true
+}
+
 type readEOF struct{}
 
 func (r readEOF) Read([]byte) (int, error) {
 	return 0, io.EOF
 }
 
-func (c *Conn) readWithRetry(p []byte, timeout time.Duration) (n int, opcode uint, final bool, err error) {
-	var retryDelay = time.Microsecond
+// ReadWithRetry reads until a non-control frame. Any control frames are passed
+// to ctrl first, when not nil. Timeouts close the connection, unless keepOnTimeout
+// is set, in which case the net.Error is returned as is.
+func (c *Conn) readWithRetry(p []byte, timeout time.Duration, ctrl func(opcode uint, payload []byte), keepOnTimeout bool) (n int, opcode uint, final bool, err error) {
+	var retryDelay, retryTotal = time.Microsecond, time.Duration(0)
 
 	for {
-		c.SetReadDeadline(time.Now().Add(timeout))
+		c.Conn.SetReadDeadline(c.readDeadline(timeout))
 		n, err = c.Read(p)
 		for err != nil {
 			e, ok := err.(net.Error)
 			if ok && e.Timeout() {
-				c.SendClose(Policy, "read timeout")
+				if !keepOnTimeout || c.pongExpired() {
+					err = c.readTimeout()
+				}
 				return
 			}
 			if !ok || !e.Temporary() {
 				return
 			}
 
+			if retryTotal += retryDelay; retryTotal > c.retryLimit() {
+				c.setClose(AbnormalClose, "read retry limit")
+				return
+			}
 			time.Sleep(retryDelay)
 			if retryDelay < time.Second {
 				retryDelay *= 2
@@ -525,15 +1450,49 @@ func (c *Conn) readWithRetry(p []byte, timeout time.Duration) (n int, opcode uin
 			return
 		}
 
-		err = c.gotCtrl(opcode, n)
+		if ctrl != nil {
+			// control frame payload is in read buffer
+			ctrl(opcode, c.readBuf[6:6+n+c.readPayloadN])
+		}
+		err = c.gotCtrl(opcode, n, timeout)
 		if err != nil {
 			return
 		}
 	}
 }
 
-// GotCtrl deals with the controll frame in the read buffer.
-func (c *Conn) gotCtrl(opcode uint, readN int) error {
+// NextDataFrame reads until the header of a non-control frame is available.
+// Control frames are dealed with. Any payload from the previous frame must be
+// consumed.
+func (c *Conn) nextDataFrame(timeout time.Duration) error {
+	for {
+		c.readMutex.Lock()
+		var err error
+		if c.readPayloadN == 0 && atomic.LoadUint32(&c.readHead)&readPeekFlag == 0 {
+			c.Conn.SetReadDeadline(c.readDeadline(timeout))
+			err = c.nextFrame()
+		}
+		c.readMutex.Unlock()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				err = c.readTimeout()
+			}
+			return err
+		}
+
+		head := uint(atomic.LoadUint32(&c.readHead))
+		if head&ctrlFlag == 0 {
+			return nil
+		}
+		if err := c.gotCtrl(head&opcodeMask, 0, timeout); err != nil {
+			return err
+		}
+	}
+}
+
+// GotCtrl deals with the controll frame in the read buffer. The timeout limits
+// the transmission of any reply.
+func (c *Conn) gotCtrl(opcode uint, readN int, timeout time.Duration) error {
 	switch opcode {
 	case Ping:
 		// reuse read buffer for pong frame
@@ -543,20 +1502,34 @@ func (c *Conn) gotCtrl(opcode uint, readN int) error {
 
 		c.writeMutex.Lock()
 		defer c.writeMutex.Unlock()
-		n, err := c.Conn.Write(pongFrame)
-		for err != nil {
+		if c.HalfDuplex {
+			c.duplexMutex.Lock()
+			defer c.duplexMutex.Unlock()
+		}
+		// write deadline from previous frame might have expired
+		c.Conn.SetWriteDeadline(c.writeDeadline(timeout))
+		c.countWriteFrame(Pong | finalFlag)
+		n, err := c.netWrite(pongFrame)
+		for retryTotal := time.Duration(0); err != nil; {
 			e, ok := err.(net.Error)
 			if ok && e.Timeout() {
 				c.setClose(Policy, "write timeout")
-				return err
+				return c.closeError()
 			}
 			if !ok || !e.Temporary() {
+				if closeErr := c.closeError(); closeErr != nil {
+					return closeErr
+				}
 				return err
 			}
 
+			if retryTotal += 100 * time.Microsecond; retryTotal > c.retryLimit() {
+				c.setClose(AbnormalClose, "write retry limit")
+				return c.closeError()
+			}
 			time.Sleep(100 * time.Microsecond)
 			var more int
-			more, err = c.Conn.Write(pongFrame[n:])
+			more, err = c.netWrite(pongFrame[n:])
 			n += more
 		}
 	}
@@ -564,6 +1537,7 @@ func (c *Conn) gotCtrl(opcode uint, readN int) error {
 	// flush payload
 	c.readBufDone += c.readPayloadN
 	c.readPayloadN = 0
+	c.readPending()
 
 	return nil
 }
@@ -2,11 +2,17 @@ package websocket
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net"
+	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
+	"unicode/utf8"
 )
 
 func TestCloseErrorInterface(t *testing.T) {
@@ -71,3 +77,1473 @@ func TestReceiveCtrlInteruption(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestServe(t *testing.T) {
+	conn, testEnd := pipeConn()
+
+	go func() {
+		_, err := io.WriteString(testEnd,
+			"\x81\x85\x00\x00\x00\x00Hello"+
+				"\x02\x83\x00\x00\x00\x00abc"+
+				"\x80\x83\x00\x00\x00\x00def"+
+				"\x88\x82\x00\x00\x00\x00\x03\xe8")
+		if err != nil {
+			t.Error("test end write error:", err)
+		}
+		io.Copy(io.Discard, testEnd)
+	}()
+
+	var got []string
+	err := conn.Serve(func(opcode uint, r io.Reader) error {
+		if opcode == Binary {
+			// read partially
+			var buf [2]byte
+			n, _ := r.Read(buf[:])
+			got = append(got, string(buf[:n]))
+			return nil
+		}
+		b, err := io.ReadAll(r)
+		got = append(got, string(b))
+		return err
+	}, time.Second, time.Second)
+	if err != ClosedError(NormalClose) {
+		t.Errorf("got error %v, want %v", err, ClosedError(NormalClose))
+	}
+	if len(got) != 2 || got[0] != "Hello" || got[1] != "ab" {
+		t.Errorf("got messages %q, want [\"Hello\" \"ab\"]", got)
+	}
+}
+
+func TestReceivePooled(t *testing.T) {
+	conn, testEnd := pipeConn()
+	conn.MessageBufferPool = new(sync.Pool)
+	go func() {
+		io.WriteString(testEnd, "\x81\x85\x00\x00\x00\x00Hello"+"\x82\x83\x00\x00\x00\x00abc")
+		io.Copy(io.Discard, testEnd)
+	}()
+
+	opcode, buf, err := conn.ReceivePooled(16, time.Second, time.Second)
+	if err != nil || opcode != Text || buf.String() != "Hello" {
+		t.Fatalf("got opcode %d with %q, error %v; want text \"Hello\"", opcode, buf, err)
+	}
+	conn.ReleaseBuffer(buf)
+
+	opcode, buf2, err := conn.ReceivePooled(16, time.Second, time.Second)
+	if err != nil || opcode != Binary || buf2.String() != "abc" {
+		t.Fatalf("got opcode %d with %q, error %v; want binary \"abc\"", opcode, buf2, err)
+	}
+	conn.ReleaseBuffer(buf2)
+
+	if _, buf, err := conn.ReceivePooled(16, time.Second, time.Millisecond); err == nil || buf != nil {
+		t.Errorf("receive after close got buffer %v with error %v, want nil with error", buf, err)
+	}
+}
+
+func TestServeMessages(t *testing.T) {
+	conn, testEnd := pipeConn()
+
+	go func() {
+		_, err := io.WriteString(testEnd,
+			"\x81\x85\x00\x00\x00\x00Hello"+
+				"\x02\x83\x00\x00\x00\x00abc"+
+				"\x80\x83\x00\x00\x00\x00def"+
+				"\x81\x81\x00\x00\x00\x00!"+
+				"\x88\x82\x00\x00\x00\x00\x03\xe8")
+		if err != nil {
+			t.Error("test end write error:", err)
+		}
+		io.Copy(io.Discard, testEnd)
+	}()
+
+	var got []string
+	conn.HandleText(func(message string) error {
+		got = append(got, "text "+message)
+		return nil
+	})
+	conn.HandleBinary(func(message []byte) error {
+		got = append(got, "binary "+string(message))
+		return nil
+	})
+	err := conn.ServeMessages(16, time.Second, time.Second)
+	if err != ClosedError(NormalClose) {
+		t.Errorf("got error %v, want %v", err, ClosedError(NormalClose))
+	}
+	want := []string{"text Hello", "binary abcdef", "text !"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got messages %q, want %q", got, want)
+	}
+
+	// handler error and overflow
+	conn, testEnd = pipeConn()
+	go func() {
+		io.WriteString(testEnd, "\x81\x85\x00\x00\x00\x00Hello")
+		io.Copy(io.Discard, testEnd)
+	}()
+	conn.HandleText(func(message string) error { return io.ErrNoProgress })
+	if err := conn.ServeMessages(16, time.Second, time.Second); err != io.ErrNoProgress {
+		t.Errorf("got error %v, want handler error %v", err, io.ErrNoProgress)
+	}
+	go io.WriteString(testEnd, "\x81\x85\x00\x00\x00\x00Hello")
+	if err := conn.ServeMessages(4, time.Second, time.Second); err != ErrOverflow {
+		t.Errorf("got error %v, want %v", err, ErrOverflow)
+	}
+}
+
+func TestSendOpcodeRange(t *testing.T) {
+	conn, testEnd := pipeConn()
+	defer testEnd.Close()
+
+	for _, opcode := range []uint{Continuation, 16, 1 << 20} {
+		if err := conn.Send(opcode, nil, time.Second); err != ErrOpcodeRange {
+			t.Errorf("opcode %d got error %v, want %v", opcode, err, ErrOpcodeRange)
+		}
+	}
+	if n := conn.Stats().WrittenFrames; n != 0 {
+		t.Errorf("got %d frames written, want none", n)
+	}
+}
+
+func TestWriteTextBinary(t *testing.T) {
+	conn, testEnd := pipeConn()
+	done := make(chan string)
+	go func() {
+		var got strings.Builder
+		io.Copy(&got, testEnd)
+		done <- got.String()
+	}()
+
+	if err := conn.WriteText("hello"); err != nil {
+		t.Error("write text error:", err)
+	}
+	if err := conn.WriteBinary([]byte{7}); err != nil {
+		t.Error("write binary error:", err)
+	}
+	conn.Close()
+	if got, want := <-done, "\x81\x05hello\x82\x01\a"; got != want {
+		t.Errorf("got %#x, want %#x", got, want)
+	}
+
+	// zero wireTimeout expires immediately, unlike zero WriteTimeout
+	conn, testEnd = pipeConn()
+	go io.Copy(io.Discard, testEnd)
+	if err := conn.Send(Text, []byte("hello"), 0); err == nil {
+		t.Error("send with zero timeout got no error")
+	}
+
+	// expiry without reads from test end
+	conn, _ = pipeConn()
+	conn.WriteTimeout = time.Millisecond
+	if err := conn.WriteText("hello"); err == nil {
+		t.Error("write text without receiver got no error")
+	}
+	if got := conn.Stats().CloseCode; got != Policy {
+		t.Errorf("got close code %d after timeout, want %d", got, Policy)
+	}
+}
+
+func TestReadMessagePing(t *testing.T) {
+	// zero timeouts apply to the pong reply too
+	conn, testEnd := pipeConn()
+	done := make(chan string)
+	go func() {
+		testEnd.Write([]byte(zeroMaskFrame(Ping|finalFlag, "p") + zeroMaskFrame(Text|finalFlag, "hello")))
+		var got strings.Builder
+		io.Copy(&got, testEnd)
+		done <- got.String()
+	}()
+
+	buf := make([]byte, 16)
+	opcode, n, err := conn.ReadMessage(buf)
+	if err != nil {
+		t.Fatal("read message error:", err)
+	}
+	if opcode != Text || string(buf[:n]) != "hello" {
+		t.Errorf("got opcode %d with %q, want %d with \"hello\"", opcode, buf[:n], Text)
+	}
+	conn.Close()
+	if got := <-done; got != "\x8a\x01p" {
+		t.Errorf("got pong %q, want \"\\x8a\\x01p\"", got)
+	}
+}
+
+func TestReadMessageCeiling(t *testing.T) {
+	// zero timeouts stay limited to the deadlines set
+	conn, testEnd := pipeConn()
+	go io.Copy(io.Discard, testEnd)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	buf := make([]byte, 16)
+	if _, _, err := conn.ReadMessage(buf); err == nil {
+		t.Error("read message past read deadline got no error")
+	}
+	if got := conn.Stats().CloseCode; got != Policy {
+		t.Errorf("got close code %d after read deadline, want %d", got, Policy)
+	}
+
+	conn, testEnd = pipeConn()
+	go io.Copy(io.Discard, testEnd)
+	conn.SetPongDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := conn.ReadMessage(buf); err == nil {
+		t.Error("read message past pong deadline got no error")
+	}
+	if got := conn.Stats().CloseCode; got != GoingAway {
+		t.Errorf("got close code %d after pong deadline, want %d", got, GoingAway)
+	}
+}
+
+func TestValidBuffers(t *testing.T) {
+	golden := []struct {
+		Bufs []string
+		Want bool
+	}{
+		{nil, true},
+		{[]string{"", "a", ""}, true},
+		{[]string{"\xf0\x9f", "", "\x98", "\x80!"}, true},
+		{[]string{"\xf0", "\x9f", "\x98", "\x80"}, true},
+		{[]string{"a\xe2\x82", "\xacb\xc3", "\xa9"}, true},
+		{[]string{"\xf0\x9f", "\x98"}, false},
+		{[]string{"\xc3", "a"}, false},
+		{[]string{"\xe2\x82", "\xac\xac"}, false},
+		{[]string{"\xed\xa0", "\x80"}, false}, // surrogate
+		{[]string{"a", "\xff", "b"}, false},
+	}
+	for _, gold := range golden {
+		var bufs net.Buffers
+		for _, s := range gold.Bufs {
+			bufs = append(bufs, []byte(s))
+		}
+		if got := validBuffers(bufs); got != gold.Want {
+			t.Errorf("%q: got valid %t, want %t", gold.Bufs, got, gold.Want)
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go func() {
+		// no limit with zero timeouts
+		time.Sleep(10 * time.Millisecond)
+		testEnd.Write([]byte(zeroMaskFrame(Text|finalFlag, "hello")))
+		io.Copy(io.Discard, testEnd)
+	}()
+
+	buf := make([]byte, 16)
+	opcode, n, err := conn.ReadMessage(buf)
+	if err != nil {
+		t.Fatal("read message error:", err)
+	}
+	if opcode != Text || string(buf[:n]) != "hello" {
+		t.Errorf("got opcode %d with %q, want %d with \"hello\"", opcode, buf[:n], Text)
+	}
+
+	// expiry without writes from test end
+	conn.IdleTimeout = time.Millisecond
+	if _, _, err := conn.ReadMessage(buf); err == nil {
+		t.Error("read message without sender got no error")
+	}
+	if got := conn.Stats().CloseCode; got != Policy {
+		t.Errorf("got close code %d after timeout, want %d", got, Policy)
+	}
+}
+
+func TestValidateOutgoingText(t *testing.T) {
+	conn, testEnd := pipeConn()
+	defer testEnd.Close()
+	conn.ValidateOutgoingText = true
+
+	if err := conn.Send(Text, []byte("\xff"), time.Second); err != ErrUTF8 {
+		t.Errorf("send got error %v, want %v", err, ErrUTF8)
+	}
+	if err := conn.WriteText("a\xc3"); err != ErrUTF8 {
+		t.Errorf("write text got error %v, want %v", err, ErrUTF8)
+	}
+	// rune split over buffers is fine
+	go io.Copy(io.Discard, testEnd)
+	if err := conn.SendBuffers(Text, net.Buffers{[]byte("\xc3"), []byte("\xa9")}, time.Second); err != nil {
+		t.Errorf("send buffers got error: %s", err)
+	}
+	if err := conn.SendBuffers(Text, net.Buffers{[]byte("\xc3"), []byte("a")}, time.Second); err != ErrUTF8 {
+		t.Errorf("send buffers got error %v, want %v", err, ErrUTF8)
+	}
+	if n := conn.Stats().WrittenFrames; n != 1 {
+		t.Errorf("got %d frames written, want 1", n)
+	}
+}
+
+func TestSendBuffers(t *testing.T) {
+	for _, gold := range GoldenFrames {
+		conn, testEnd := pipeConn()
+		done := make(chan string)
+		go func() {
+			var got strings.Builder
+			io.Copy(&got, testEnd)
+			done <- got.String()
+		}()
+
+		// split in three
+		m := gold.Message
+		bufs := net.Buffers{[]byte(m[:len(m)/3]), []byte(m[len(m)/3 : len(m)/2]), []byte(m[len(m)/2:])}
+		if err := conn.SendBuffers(gold.Opcode, bufs, time.Second); err != nil {
+			t.Errorf("%#x: send error: %s", gold.Frame, err)
+		}
+		conn.Close()
+		if got := <-done; got != gold.Frame {
+			t.Errorf("%#x: got %#x", gold.Frame, got)
+		}
+		if got := conn.Stats().WrittenBytes; got != uint64(len(gold.Frame)) {
+			t.Errorf("%#x: got %d bytes written, want %d", gold.Frame, got, len(gold.Frame))
+		}
+	}
+}
+
+func TestSendStreamBusy(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go io.Copy(io.Discard, testEnd)
+
+	w := conn.SendStream(Binary, time.Second)
+	if _, err := conn.SendStream(Text, time.Second).Write([]byte("x")); err != ErrStreamBusy {
+		t.Errorf("second stream got write error %v, want %v", err, ErrStreamBusy)
+	}
+	if err := conn.Send(Binary, nil, time.Second); err != ErrStreamBusy {
+		t.Errorf("binary send got error %v, want %v", err, ErrStreamBusy)
+	}
+	if err := conn.Send(Ping, nil, time.Second); err != nil {
+		t.Error("ping send error:", err)
+	}
+	if _, err := w.Write([]byte("x")); err != nil {
+		t.Error("stream write error:", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error("stream close error:", err)
+	}
+
+	if err := conn.Send(Binary, nil, time.Second); err != nil {
+		t.Error("binary send after stream close error:", err)
+	}
+	w = conn.SendStream(Text, time.Second)
+	if err := w.Close(); err != nil {
+		t.Error("new stream close error:", err)
+	}
+	// redundant Close must not release another stream
+	w = conn.SendStream(Binary, time.Second)
+	if err := conn.SendStream(Binary, time.Second).Close(); err != ErrStreamBusy {
+		t.Errorf("rejected stream got close error %v, want %v", err, ErrStreamBusy)
+	}
+	if err := conn.Send(Binary, nil, time.Second); err != ErrStreamBusy {
+		t.Errorf("binary send got error %v, want %v", err, ErrStreamBusy)
+	}
+	w.Close()
+}
+
+func TestSendStreamOpcodePanic(t *testing.T) {
+	for _, opcode := range []uint{Continuation, 16, Close, Ping, Pong, Reserved15} {
+		conn, testEnd := pipeConn()
+		go io.Copy(io.Discard, testEnd)
+
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("opcode %d got no panic", opcode)
+				}
+			}()
+			conn.SendStream(opcode, time.Second)
+		}()
+
+		// no stream in progress
+		if err := conn.Send(Binary, nil, time.Second); err != nil {
+			t.Errorf("opcode %d: send after panic got error: %s", opcode, err)
+		}
+		if n := conn.Stats().WrittenFrames; n != 1 {
+			t.Errorf("opcode %d: got %d frames written, want 1", opcode, n)
+		}
+	}
+}
+
+func TestSendStreamWriteMode(t *testing.T) {
+	conn, testEnd := pipeConn()
+	done := make(chan string)
+	go func() {
+		var got strings.Builder
+		io.Copy(&got, testEnd)
+		done <- got.String()
+	}()
+
+	w := conn.SendStream(Binary, time.Second)
+	if _, err := w.Write([]byte("a")); err != nil {
+		t.Fatal("stream write error:", err)
+	}
+	// low-level interruption
+	conn.SetWriteMode(Text, true)
+	if _, err := conn.Write([]byte("x")); err != ErrWriteMode {
+		t.Errorf("text write during stream got error %v, want %v", err, ErrWriteMode)
+	}
+	if _, err := w.Write([]byte("b")); err != nil {
+		t.Error("stream write error:", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Error("stream close error:", err)
+	}
+	conn.Close()
+
+	if got, want := <-done, "\x02\x01a\x00\x01b\x80\x00"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSendStreamBytesSent(t *testing.T) {
+	conn, testEnd := pipeConn()
+	conn.StreamCoalesce = 8
+	go io.Copy(io.Discard, testEnd)
+
+	type counter interface{ BytesSent() int64 }
+	for _, opcode := range []uint{Binary, Text} {
+		w := conn.SendStream(opcode, time.Second)
+		if n := w.(counter).BytesSent(); n != 0 {
+			t.Errorf("opcode %d: got %d bytes sent before write, want 0", opcode, n)
+		}
+		io.WriteString(w, "abc")
+		io.WriteString(w, "defghijk")
+		if n := w.(counter).BytesSent(); n != 11 {
+			t.Errorf("opcode %d: got %d bytes sent, want 11", opcode, n)
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("opcode %d: close error: %s", opcode, err)
+		}
+	}
+	if n := conn.SendStream(Binary, time.Second).(counter).BytesSent(); n != 0 {
+		t.Errorf("new stream got %d bytes sent, want 0", n)
+	}
+}
+
+func TestSendStreamAbort(t *testing.T) {
+	for _, opcode := range []uint{Binary, Text} {
+		conn, testEnd := pipeConn()
+		done := make(chan string)
+		go func() {
+			var got strings.Builder
+			io.Copy(&got, testEnd)
+			done <- got.String()
+		}()
+
+		w := conn.SendStream(opcode, time.Second)
+		if _, err := w.Write([]byte("abc")); err != nil {
+			t.Fatal("stream write error:", err)
+		}
+		aborter, ok := w.(interface{ Abort(uint, string) error })
+		if !ok {
+			t.Fatalf("opcode %d: stream has no Abort method", opcode)
+		}
+		if err := aborter.Abort(Unexpected, "abort"); err != ClosedError(Unexpected) {
+			t.Errorf("opcode %d: got abort error %v, want %v", opcode, err, ClosedError(Unexpected))
+		}
+
+		if _, err := w.Write([]byte("d")); err != io.ErrClosedPipe {
+			t.Errorf("opcode %d: write after abort got error %v, want %v", opcode, err, io.ErrClosedPipe)
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("opcode %d: close after abort got error %v", opcode, err)
+		}
+		if err := aborter.Abort(Unexpected, "again"); err != io.ErrClosedPipe {
+			t.Errorf("opcode %d: second abort got error %v, want %v", opcode, err, io.ErrClosedPipe)
+		}
+		if err := conn.Send(Binary, nil, time.Second); err != ErrStreamBusy {
+			t.Errorf("opcode %d: send after abort got error %v, want %v", opcode, err, ErrStreamBusy)
+		}
+
+		conn.Close()
+		want := string([]byte{byte(opcode), 3}) + "abc" + "\x88\x07\x03\xf3abort"
+		if got := <-done; got != want {
+			t.Errorf("opcode %d: got %q, want %q", opcode, got, want)
+		}
+	}
+}
+
+func TestStreamBufferSize(t *testing.T) {
+	conn, testEnd := pipeConn()
+	conn.StreamBufferSize = 4
+	done := make(chan []byte)
+	go func() {
+		var got bytes.Buffer
+		io.Copy(&got, testEnd)
+		done <- got.Bytes()
+	}()
+
+	w := conn.SendStream(Binary, time.Second)
+	// stall transmission
+	conn.writeMutex.Lock()
+	var queued []byte
+	for i := 0; ; i++ {
+		if i > 8 {
+			conn.writeMutex.Unlock()
+			t.Fatalf("accepted %q without ErrWouldBlock; queue exceeds 4 bytes", queued)
+		}
+		c := byte('a' + i)
+		n, err := w.Write([]byte{c})
+		if err == ErrWouldBlock {
+			if n != 0 {
+				t.Errorf("got %d bytes written with ErrWouldBlock, want 0", n)
+			}
+			break
+		}
+		if err != nil {
+			conn.writeMutex.Unlock()
+			t.Fatal("stream write error:", err)
+		}
+		queued = append(queued, c)
+	}
+	if len(queued) < 4 {
+		t.Errorf("accepted %q before ErrWouldBlock, want 4 bytes or more", queued)
+	}
+	conn.writeMutex.Unlock()
+
+	if err := w.Close(); err != nil {
+		t.Fatal("stream close error:", err)
+	}
+	conn.Close()
+
+	// concatenate frame payloads
+	frames := <-done
+	var payload []byte
+	var lastHead byte
+	for len(frames) >= 2 {
+		lastHead = frames[0]
+		size := int(frames[1])
+		payload = append(payload, frames[2:2+size]...)
+		frames = frames[2+size:]
+	}
+	if string(payload) != string(queued) {
+		t.Errorf("got payload %q, want %q", payload, queued)
+	}
+	if lastHead != Continuation|finalFlag {
+		t.Errorf("got last frame header %#x, want final continuation", lastHead)
+	}
+}
+
+func TestStreamBufferSizeError(t *testing.T) {
+	conn, testEnd := pipeConn()
+	conn.StreamBufferSize = 16
+	go io.Copy(io.Discard, testEnd)
+
+	w := conn.SendStream(Text, time.Second)
+	if _, err := w.Write([]byte("a\xff")); err != nil {
+		t.Fatal("stream write error:", err)
+	}
+	if err := w.Close(); err != ErrUTF8 {
+		t.Errorf("stream close got error %v, want %v", err, ErrUTF8)
+	}
+	// stream released
+	if err := conn.Send(Binary, []byte{1}, time.Second); err != nil {
+		t.Error("send after stream failure got error:", err)
+	}
+}
+
+func TestStreamCoalesce(t *testing.T) {
+	conn, testEnd := pipeConn()
+	conn.StreamCoalesce = 16
+	done := make(chan string)
+	go func() {
+		var got strings.Builder
+		io.Copy(&got, testEnd)
+		done <- got.String()
+	}()
+
+	for _, opcode := range []uint{Binary, Text} {
+		w := conn.SendStream(opcode, time.Second)
+		for i := 0; i < 10; i++ {
+			if n, err := w.Write([]byte("ab")); n != 2 || err != nil {
+				t.Errorf("opcode %d: write %d got (%d, %v), want (2, nil)", opcode, i, n, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("opcode %d: close error: %s", opcode, err)
+		}
+	}
+	conn.Close()
+
+	const frames = "\x02\x10abababababababab" + "\x80\x04abab" +
+		"\x01\x10abababababababab" + "\x80\x04abab"
+	if got := <-done; got != frames {
+		t.Errorf("got %q", got)
+		t.Errorf("want %q", frames)
+	}
+}
+
+func TestSendStreamReadFrom(t *testing.T) {
+	conn, testEnd := pipeConn()
+	data := strings.Repeat("0123456789", 4000)
+
+	done := make(chan error)
+	go func() {
+		w := conn.SendStream(Binary, time.Second)
+		// hide io.WriterTo from strings.Reader
+		_, err := io.Copy(w, struct{ io.Reader }{strings.NewReader(data)})
+		if err == nil {
+			err = w.Close()
+		}
+		done <- err
+	}()
+
+	var got []byte
+	var frameN int
+	r := NewReader(make([]byte, 64*1024))
+	for final := false; !final; {
+		payload, err := r.NextFrame()
+		if err == ErrUnderflow {
+			if err := r.ReadSome(testEnd); err != nil {
+				t.Fatal("test end read error:", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal("frame error:", err)
+		}
+		got = append(got, payload...)
+		frameN++
+		final = r.IsFinal()
+	}
+	if err := <-done; err != nil {
+		t.Error("copy error:", err)
+	}
+	if string(got) != data {
+		t.Errorf("got %d bytes of message, want %d", len(got), len(data))
+	}
+	// two reads from copy, plus an empty final frame
+	if frameN != 3 {
+		t.Errorf("got %d frames, want 3", frameN)
+	}
+}
+
+func TestReceiveStreamWriteTo(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go io.WriteString(testEnd, fragmentedText("Hello", ", ", "World!"))
+
+	_, r, err := conn.ReceiveStream(time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if _, ok := r.(io.WriterTo); !ok {
+		t.Fatal("stream reader does not implement io.WriterTo")
+	}
+	var got bytes.Buffer
+	n, err := io.Copy(&got, r)
+	if err != nil {
+		t.Error("copy error:", err)
+	}
+	if got.String() != "Hello, World!" || n != int64(got.Len()) {
+		t.Errorf("got %d bytes %q, want \"Hello, World!\"", n, got.String())
+	}
+}
+
+func TestPongWriteTimeout(t *testing.T) {
+	conn, testEnd := pipeConn()
+	// no reads from test end
+	go io.WriteString(testEnd, zeroMaskFrame(Ping|finalFlag, "p"))
+
+	var buf [8]byte
+	_, _, err := conn.Receive(buf[:], 20*time.Millisecond, 20*time.Millisecond)
+	var closed ClosedError
+	if !errors.As(err, &closed) || closed != Policy {
+		t.Errorf("got error %v, want %v", err, ClosedError(Policy))
+	}
+}
+
+func TestPongDeadline(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go io.Copy(io.Discard, testEnd)
+	conn.SetPongDeadline(time.Now().Add(10 * time.Millisecond))
+	_, _, err := conn.Receive(nil, time.Second, time.Second)
+	if err == nil {
+		t.Error("receive without pong got no error")
+	}
+	if got := conn.Stats().CloseCode; got != GoingAway {
+		t.Errorf("got close code %d, want %d", got, GoingAway)
+	}
+
+	// pong clears deadline
+	conn, testEnd = pipeConn()
+	conn.SetPongDeadline(time.Now().Add(10 * time.Millisecond))
+	go func() {
+		io.WriteString(testEnd, zeroMaskFrame(Pong|finalFlag, ""))
+		time.Sleep(20 * time.Millisecond)
+		io.WriteString(testEnd, zeroMaskFrame(Binary|finalFlag, "late"))
+	}()
+	var buf [8]byte
+	_, n, err := conn.Receive(buf[:], time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if got := string(buf[:n]); got != "late" {
+		t.Errorf("got message %q, want \"late\"", got)
+	}
+}
+
+func TestPeekMessage(t *testing.T) {
+	for _, gold := range GoldenFrames {
+		conn, testEnd := pipeConn()
+		go io.WriteString(testEnd, "\x89\x80\x00\x00\x00\x00"+gold.Masked)
+		go io.Copy(io.Discard, testEnd)
+
+		want := gold.Message
+		if len(want) > 125 {
+			want = want[:125]
+		}
+		for i := 0; i < 2; i++ {
+			got, err := conn.PeekMessage(200, time.Second)
+			if err != nil {
+				t.Fatalf("%#x: peek %d error: %s", gold.Masked, i, err)
+			}
+			if string(got) != want {
+				t.Errorf("%#x: peek %d got %#x, want %#x", gold.Masked, i, got, want)
+			}
+		}
+		if got, err := conn.PeekMessage(2, time.Second); err != nil || len(got) > 2 || string(got) != want[:len(got)] {
+			t.Errorf("%#x: peek 2 bytes got %#x, error %v", gold.Masked, got, err)
+		}
+
+		buf := make([]byte, len(gold.Message)+1)
+		opcode, n, err := conn.Receive(buf, time.Second, time.Second)
+		if err != nil {
+			t.Fatalf("%#x: receive error: %s", gold.Masked, err)
+		}
+		if opcode != gold.Opcode {
+			t.Errorf("%#x: got opcode %d, want %d", gold.Masked, opcode, gold.Opcode)
+		}
+		if string(buf[:n]) != gold.Message {
+			t.Errorf("%#x: got message %#x", gold.Masked, buf[:n])
+		}
+	}
+
+	// fragmented with stream
+	conn, testEnd := pipeConn()
+	go io.WriteString(testEnd, fragmentedText("", "Hel", "lo"))
+	if got, err := conn.PeekMessage(5, time.Second); err != nil || len(got) != 0 {
+		t.Errorf("peek got %q, error %v; want empty first frame", got, err)
+	}
+	opcode, r, err := conn.ReceiveStream(time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive stream error:", err)
+	}
+	got, err := io.ReadAll(r)
+	if opcode != Text || string(got) != "Hello" || err != nil {
+		t.Errorf("got opcode %d, message %q, error %v; want Text \"Hello\"", opcode, got, err)
+	}
+}
+
+func TestNextMessageIsText(t *testing.T) {
+	for _, gold := range GoldenFrames {
+		conn, testEnd := pipeConn()
+		go io.WriteString(testEnd, "\x89\x80\x00\x00\x00\x00"+gold.Masked)
+		go io.Copy(io.Discard, testEnd)
+
+		isText, err := conn.NextMessageIsText(time.Second)
+		if err != nil {
+			t.Fatalf("%#x: got error: %s", gold.Masked, err)
+		}
+		if want := gold.Opcode == Text; isText != want {
+			t.Errorf("%#x: got %t, want %t", gold.Masked, isText, want)
+		}
+
+		buf := make([]byte, len(gold.Message)+1)
+		opcode, n, err := conn.Receive(buf, time.Second, time.Second)
+		if err != nil {
+			t.Fatalf("%#x: receive error: %s", gold.Masked, err)
+		}
+		if opcode != gold.Opcode || string(buf[:n]) != gold.Message {
+			t.Errorf("%#x: got opcode %d with message %#x", gold.Masked, opcode, buf[:n])
+		}
+	}
+}
+
+func TestReceiveEOF(t *testing.T) {
+	golden := []struct {
+		Input string
+		Want  error
+	}{
+		{"", io.EOF},
+		{"\x82\x81\x00\x00\x00\x00a", io.EOF},
+		{"\x82", io.ErrUnexpectedEOF},
+		{"\x82\x85\x00\x00\x00\x00abc", io.ErrUnexpectedEOF},
+		{"\x88\x82\x00\x00\x00\x00\x03\xe8", ClosedError(NormalClose)},
+	}
+	for _, gold := range golden {
+		conn, testEnd := pipeConn()
+		go func(input string) {
+			io.WriteString(testEnd, input)
+			testEnd.Close()
+		}(gold.Input)
+
+		var buf [8]byte
+		var err error
+		for err == nil {
+			_, _, err = conn.Receive(buf[:], time.Second, time.Second)
+		}
+		if err != gold.Want {
+			t.Errorf("%q: got error %v, want %v", gold.Input, err, gold.Want)
+		}
+		if gold.Want == io.EOF {
+			if code := conn.Stats().CloseCode; code != AbnormalClose {
+				t.Errorf("%q: got close code %d, want %d", gold.Input, code, AbnormalClose)
+			}
+		}
+	}
+}
+
+func TestReceiveTimeout(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go io.Copy(io.Discard, testEnd)
+	_, _, err := conn.Receive(nil, time.Millisecond, time.Millisecond)
+	if err != ClosedError(Policy) {
+		t.Errorf("idle expiry got error %v, want %v", err, ClosedError(Policy))
+	}
+
+	// expiry halfway a message
+	conn, testEnd = pipeConn()
+	go io.Copy(io.Discard, testEnd)
+	go io.WriteString(testEnd, "\x02\x80\x00\x00\x00\x00")
+	_, r, err := conn.ReceiveStream(time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if _, err := io.ReadAll(r); err != ClosedError(Policy) {
+		t.Errorf("wire expiry got error %v, want %v", err, ClosedError(Policy))
+	}
+}
+
+func TestDeadlineCeiling(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go io.Copy(io.Discard, testEnd)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	start := time.Now()
+	_, _, err := conn.Receive(nil, time.Second, time.Second)
+	if err != ClosedError(Policy) {
+		t.Errorf("ceiling expiry got error %v, want %v", err, ClosedError(Policy))
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("receive took %s; read deadline ignored", d)
+	}
+
+	// clear ceiling
+	conn, testEnd = pipeConn()
+	conn.SetReadDeadline(time.Now().Add(-time.Second))
+	conn.SetReadDeadline(time.Time{})
+	go io.WriteString(testEnd, "\x82\x80\x00\x00\x00\x00")
+	if _, _, err := conn.Receive(nil, time.Second, time.Second); err != nil {
+		t.Error("receive after clear got error:", err)
+	}
+
+	// no reads from test end
+	conn, _ = pipeConn()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	start = time.Now()
+	if err := conn.Send(Binary, nil, time.Second); err == nil {
+		t.Error("send after ceiling expiry got no error")
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("send took %s; write deadline ignored", d)
+	}
+}
+
+func TestReceiveStreamClose(t *testing.T) {
+	for _, opcode := range []uint{Binary, Text} {
+		conn, testEnd := pipeConn()
+		go func() {
+			io.WriteString(testEnd, zeroMaskFrame(byte(opcode), "abc"))
+			// close halfway the message
+			io.WriteString(testEnd, zeroMaskFrame(Close|finalFlag, "\x03\xe9bye"))
+			io.Copy(io.Discard, testEnd)
+		}()
+
+		_, r, err := conn.ReceiveStream(time.Second, time.Second)
+		if err != nil {
+			t.Fatal("receive error:", err)
+		}
+		got, err := io.ReadAll(r)
+		if string(got) != "abc" || err != ClosedError(GoingAway) {
+			t.Errorf("opcode %d: got %q with error %v, want \"abc\" with %v", opcode, got, err, ClosedError(GoingAway))
+		}
+		if _, err := r.Read(make([]byte, 1)); err != ClosedError(GoingAway) {
+			t.Errorf("opcode %d: read after close got error %v, want %v", opcode, err, ClosedError(GoingAway))
+		}
+	}
+}
+
+func TestStreamTimeoutRecoverable(t *testing.T) {
+	conn, testEnd := pipeConn()
+	conn.StreamTimeoutRecoverable = true
+	go io.WriteString(testEnd, "\x02\x81\x00\x00\x00\x00a")
+	_, r, err := conn.ReceiveStream(10*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	var buf [8]byte
+	if n, err := r.Read(buf[:]); err != nil || string(buf[:n]) != "a" {
+		t.Fatalf("first read got %q with error %v, want \"a\"", buf[:n], err)
+	}
+
+	_, err = r.Read(buf[:])
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("read got error %v, want a net.Error with Timeout", err)
+	}
+	if code := conn.Stats().CloseCode; code != 0 {
+		t.Errorf("got close code %d after timeout, want none", code)
+	}
+
+	go io.WriteString(testEnd, "\x80\x81\x00\x00\x00\x00b")
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "b" {
+		t.Errorf("read after timeout got %q with error %v, want \"b\"", got, err)
+	}
+}
+
+func TestStreamTimeoutHeaderSplit(t *testing.T) {
+	golden := []struct{ Head, Tail, Want string }{
+		{"\x80\x81", "\x00\x00\x00\x00b", "b"},
+		{"\x80\xfe\x00\x03\x00", "\x00\x00\x00bcd", "bcd"},
+		{"\x89\x81\x00\x00", "\x00\x00p\x80\x81\x00\x00\x00\x00b", "b"},
+	}
+	for _, gold := range golden {
+		conn, testEnd := pipeConn()
+		conn.StreamTimeoutRecoverable = true
+		go io.WriteString(testEnd, "\x02\x81\x00\x00\x00\x00a"+gold.Head)
+		_, r, err := conn.ReceiveStream(10*time.Millisecond, time.Second)
+		if err != nil {
+			t.Fatal("receive error:", err)
+		}
+		var buf [8]byte
+		if n, err := r.Read(buf[:]); err != nil || string(buf[:n]) != "a" {
+			t.Fatalf("%q: first read got %q with error %v, want \"a\"", gold.Head, buf[:n], err)
+		}
+
+		// timeout halfway frame header
+		_, err = r.Read(buf[:])
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Fatalf("%q: read got error %v, want a net.Error with Timeout", gold.Head, err)
+		}
+
+		go func() {
+			io.WriteString(testEnd, gold.Tail)
+			io.Copy(io.Discard, testEnd) // pong
+		}()
+		got, err := io.ReadAll(r)
+		if err != nil || string(got) != gold.Want {
+			t.Errorf("%q: read after timeout got %q with error %v, want %q", gold.Head, got, err, gold.Want)
+		}
+		if code := conn.Stats().CloseCode; code != 0 {
+			t.Errorf("%q: got close code %d, want none", gold.Head, code)
+		}
+	}
+}
+
+func TestWaitClose(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go io.Copy(io.Discard, testEnd)
+
+	got := make(chan ClosedError, 2)
+	for i := 0; i < 2; i++ {
+		go func() { got <- conn.WaitClose() }()
+	}
+	select {
+	case err := <-got:
+		t.Fatalf("got %v before close", err)
+	case <-time.After(10 * time.Millisecond):
+		break
+	}
+
+	conn.SendClose(GoingAway, "")
+	for i := 0; i < 2; i++ {
+		if err := <-got; err != ClosedError(GoingAway) {
+			t.Errorf("got %v, want %v", err, ClosedError(GoingAway))
+		}
+	}
+	// after the fact
+	if err := conn.WaitClose(); err != ClosedError(GoingAway) {
+		t.Errorf("got %v, want %v", err, ClosedError(GoingAway))
+	}
+}
+
+func TestCloseCode(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go io.Copy(io.Discard, testEnd)
+
+	if code, closed := conn.CloseCode(); closed || code != 0 {
+		t.Errorf("got code %d, closed %t; want 0, false", code, closed)
+	}
+	conn.SendClose(GoingAway, "")
+	conn.SendClose(NormalClose, "")
+	if code, closed := conn.CloseCode(); !closed || code != GoingAway {
+		t.Errorf("got code %d, closed %t; want %d, true", code, closed, GoingAway)
+	}
+}
+
+func TestOnClose(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go io.Copy(io.Discard, testEnd)
+
+	got := make(chan ClosedError, 4)
+	for i := 0; i < 2; i++ {
+		conn.OnClose(func(err ClosedError) { got <- err })
+	}
+	conn.SendClose(Policy, "")
+	conn.SendClose(NormalClose, "")
+	conn.CloseNow()
+	// after the fact
+	conn.OnClose(func(err ClosedError) { got <- err })
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-got:
+			if err != ClosedError(Policy) {
+				t.Errorf("got %v, want %v", err, ClosedError(Policy))
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("callback %d not fired", i)
+		}
+	}
+	select {
+	case err := <-got:
+		t.Errorf("redundant callback with %v", err)
+	case <-time.After(10 * time.Millisecond):
+		break
+	}
+}
+
+func TestIsControl(t *testing.T) {
+	for opcode := uint(Continuation); opcode <= Reserved15; opcode++ {
+		want := opcode >= Close
+		if got := IsControl(opcode); got != want {
+			t.Errorf("opcode %d got control %t, want %t", opcode, got, want)
+		}
+	}
+	for _, opcode := range []uint{16, 24, 1 << 20} {
+		if IsControl(opcode) {
+			t.Errorf("opcode %d out of range got control", opcode)
+		}
+	}
+}
+
+func TestReceiveBuffer(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go io.Copy(io.Discard, testEnd)
+	go io.WriteString(testEnd, fragmentedText("Hello", ", ", "World!")+
+		zeroMaskFrame(Binary|finalFlag, "")+
+		zeroMaskFrame(Binary|finalFlag, "abc")+
+		zeroMaskFrame(Binary|finalFlag, "12345678"))
+
+	var buf bytes.Buffer
+	buf.WriteString("> ")
+	opcode, err := conn.ReceiveBuffer(&buf, 13, time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if opcode != Text || buf.String() != "> Hello, World!" {
+		t.Errorf("got opcode %d with buffer %q, want Text with \"> Hello, World!\"", opcode, buf.String())
+	}
+
+	buf.Reset()
+	opcode, err = conn.ReceiveBuffer(&buf, 13, time.Second, time.Second)
+	if err != nil || opcode != Binary || buf.Len() != 0 {
+		t.Errorf("got opcode %d, error %v and buffer %q, want Binary and empty", opcode, err, buf.String())
+	}
+
+	// no overflow on limit
+	opcode, err = conn.ReceiveBuffer(&buf, math.MaxInt, time.Second, time.Second)
+	if err != nil || opcode != Binary || buf.String() != "abc" {
+		t.Errorf("got opcode %d, error %v and buffer %q with max MaxInt, want Binary \"abc\"", opcode, err, buf.String())
+	}
+
+	_, err = conn.ReceiveBuffer(&buf, 7, time.Second, time.Second)
+	if err != ErrOverflow {
+		t.Errorf("got error %v, want %v", err, ErrOverflow)
+	}
+	if got := conn.Stats().CloseCode; got != TooBig {
+		t.Errorf("got close code %d, want %d", got, TooBig)
+	}
+}
+
+func TestReceiveInPlace(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go func() {
+		_, err := io.WriteString(testEnd,
+			"\x89\x81\x00\x00\x00\x00."+
+				"\x82\x83\x00\x00\x00\x00abc")
+		if err != nil {
+			t.Error("test end write error:", err)
+		}
+	}()
+	go io.Copy(io.Discard, testEnd)
+
+	opcode, payload, err := conn.ReceiveInPlace(nil, time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if opcode != Binary || string(payload) != "abc" {
+		t.Errorf("got opcode %d with payload %q, want binary \"abc\"", opcode, payload)
+	}
+	if &payload[0] != &conn.readBuf[conn.readBufDone-3] {
+		t.Error("payload is not a slice of the read buffer")
+	}
+}
+
+func TestReceiveInPlaceFallback(t *testing.T) {
+	for _, gold := range append(GoldenFrames[3:], GoldenFrames[:3]...) {
+		conn, testEnd := pipeConn()
+		go func() {
+			_, err := io.Copy(testEnd, iotest.OneByteReader(strings.NewReader(gold.Masked)))
+			if err != nil {
+				t.Errorf("%#x: test end write error: %s", gold.Masked, err)
+			}
+		}()
+
+		buf := make([]byte, len(gold.Message)+1)
+		opcode, payload, err := conn.ReceiveInPlace(buf, time.Second, time.Second)
+		if err != nil {
+			t.Errorf("%#x: receive error: %s", gold.Masked, err)
+			continue
+		}
+		if opcode != gold.Opcode {
+			t.Errorf("%#x: got opcode %d, want %d", gold.Masked, opcode, gold.Opcode)
+		}
+		if string(payload) != gold.Message {
+			t.Errorf("%#x: got %#x", gold.Masked, payload)
+			t.Errorf("%#x: want %#x", gold.Masked, gold.Message)
+		}
+	}
+}
+
+func TestReadFrameInto(t *testing.T) {
+	conn, testEnd := pipeConn()
+	go func() {
+		_, err := io.WriteString(testEnd,
+			"\x02\x83\x00\x00\x00\x00abc"+
+				"\x89\x81\x00\x00\x00\x00."+
+				"\x80\x82\x00\x00\x00\x00de")
+		if err != nil {
+			t.Error("test end write error:", err)
+		}
+	}()
+	go io.Copy(io.Discard, testEnd)
+
+	var buf [3]byte
+	opcode, final, n, err := conn.ReadFrameInto(buf[:2], time.Second, time.Second)
+	if err != ErrOverflow {
+		t.Fatalf("got error %v, want ErrOverflow", err)
+	}
+	if opcode != Binary || final || n != 0 {
+		t.Errorf("overflow got opcode %d, final %t, %d bytes; want binary, false, 0 bytes", opcode, final, n)
+	}
+
+	opcode, final, n, err = conn.ReadFrameInto(buf[:], time.Second, time.Second)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if opcode != Binary || final || string(buf[:n]) != "abc" {
+		t.Errorf("got opcode %d, final %t, payload %q; want binary, false, \"abc\"", opcode, final, buf[:n])
+	}
+
+	// ping in between
+	opcode, final, n, err = conn.ReadFrameInto(buf[:], time.Second, time.Second)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if opcode != Continuation || !final || string(buf[:n]) != "de" {
+		t.Errorf("got opcode %d, final %t, payload %q; want continuation, true, \"de\"", opcode, final, buf[:n])
+	}
+}
+
+func TestFullDuplexDeadlines(t *testing.T) {
+	conn, testEnd := pipeConn()
+
+	pongs := make(chan string, 1)
+	go func() {
+		var buf [64]byte
+		for {
+			n, err := testEnd.Read(buf[:])
+			if err != nil {
+				close(pongs)
+				return
+			}
+			if n >= 2 && buf[0] == Pong|finalFlag {
+				pongs <- string(buf[2:n])
+			}
+		}
+	}()
+
+	// expire the write deadline from Send before the Ping arrives
+	if err := conn.Send(Binary, []byte("x"), time.Millisecond); err != nil {
+		t.Fatal("send error:", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	go func() {
+		_, err := io.WriteString(testEnd,
+			"\x89\x81\x00\x00\x00\x00."+
+				"\x81\x82\x00\x00\x00\x00hi")
+		if err != nil {
+			t.Error("test end write error:", err)
+		}
+	}()
+
+	var buf [8]byte
+	_, n, err := conn.Receive(buf[:], time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	if got := string(buf[:n]); got != "hi" {
+		t.Errorf("got message %q, want \"hi\"", got)
+	}
+	if got := <-pongs; got != "." {
+		t.Errorf("got pong %q, want \".\"", got)
+	}
+}
+
+func TestStreamCtrlListener(t *testing.T) {
+	conn, testEnd := pipeConn()
+
+	var got []string
+	conn.StreamCtrlListener = func(opcode uint, payload []byte) {
+		got = append(got, fmt.Sprintf("%d:%s", opcode, payload))
+	}
+
+	go func() {
+		_, err := io.WriteString(testEnd,
+			"\x02\x83\x00\x00\x00\x00abc"+
+				"\x89\x82\x00\x00\x00\x00p1"+
+				"\x8a\x82\x00\x00\x00\x00p2"+
+				"\x80\x83\x00\x00\x00\x00def")
+		if err != nil {
+			t.Error("test end write error:", err)
+		}
+	}()
+	go io.Copy(io.Discard, testEnd)
+
+	_, r, err := conn.ReceiveStream(time.Second, time.Second)
+	if err != nil {
+		t.Fatal("receive error:", err)
+	}
+	message, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal("read error:", err)
+	}
+	if string(message) != "abcdef" {
+		t.Errorf("got message %q, want \"abcdef\"", message)
+	}
+	if len(got) != 2 || got[0] != "9:p1" || got[1] != "10:p2" {
+		t.Errorf("got control frames %q, want [\"9:p1\" \"10:p2\"]", got)
+	}
+}
+
+// ZeroMaskFrame returns a frame with a zero mask key, which keeps the payload
+// as is.
+func zeroMaskFrame(head byte, payload string) string {
+	return string([]byte{head, maskFlag | byte(len(payload)), 0, 0, 0, 0}) + payload
+}
+
+// FragmentedText returns a text message for each payload as a frame.
+func fragmentedText(payloads ...string) string {
+	var frames string
+	for i, payload := range payloads {
+		head := byte(Continuation)
+		if i == 0 {
+			head = Text
+		}
+		if i == len(payloads)-1 {
+			head |= finalFlag
+		}
+		frames += zeroMaskFrame(head, payload)
+	}
+	return frames
+}
+
+func TestReceiveStreamRuneBoundary(t *testing.T) {
+	golden := []struct {
+		Frames []string
+		Valid  bool
+	}{
+		{[]string{"€"}, true},
+		{[]string{"\xe2", "\x82\xac"}, true},
+		{[]string{"\xe2\x82", "\xac"}, true},
+		{[]string{"x\xe2", "\x82", "\xacy"}, true},
+		{[]string{"\xf0\x9f\x98", "\x80"}, true},
+		// truncated on final frame
+		{[]string{"\xe2\x82"}, false},
+		{[]string{"€", "\xe2"}, false},
+		{[]string{"\xe2", "\x82"}, false},
+		{[]string{"x", "\xf0\x9f\x98"}, false},
+		// broken sequence
+		{[]string{"\xe2", "x\xac"}, false},
+	}
+	for _, gold := range golden {
+		conn, testEnd := pipeConn()
+		go io.WriteString(testEnd, fragmentedText(gold.Frames...))
+		go io.Copy(io.Discard, testEnd)
+
+		_, r, err := conn.ReceiveStream(time.Second, time.Second)
+		if err != nil {
+			t.Errorf("%q: receive error: %s", gold.Frames, err)
+			continue
+		}
+		got, err := io.ReadAll(r)
+		if gold.Valid {
+			if err != nil || string(got) != strings.Join(gold.Frames, "") {
+				t.Errorf("%q: got %q with error %v", gold.Frames, got, err)
+			}
+		} else if err != ErrUTF8 {
+			t.Errorf("%q: got %q with error %v, want %v", gold.Frames, got, err, ErrUTF8)
+		}
+	}
+}
+
+func TestSendStreamRuneBoundary(t *testing.T) {
+	golden := []struct {
+		Writes []string
+		Valid  bool
+	}{
+		{[]string{"€"}, true},
+		{[]string{"\xe2", "\x82\xac"}, true},
+		{[]string{"\xe2\x82", "\xac"}, true},
+		{[]string{"x\xe2", "\x82", "\xacy"}, true},
+		{[]string{"\xf0", "\x9f", "\x98", "\x80"}, true},
+		{[]string{"héllo wörld", "€", ""}, true},
+		// truncated on Close
+		{[]string{"\xe2\x82"}, false},
+		{[]string{"x", "\xf0\x9f\x98"}, false},
+	}
+	for _, coalesce := range []int{0, 64} {
+		for _, gold := range golden {
+			conn, testEnd := pipeConn()
+			conn.StreamCoalesce = coalesce
+			done := make(chan string)
+			go func() {
+				var frames strings.Builder
+				io.Copy(&frames, testEnd)
+				done <- frames.String()
+			}()
+
+			w := conn.SendStream(Text, time.Second)
+			for _, s := range gold.Writes {
+				if n, err := io.WriteString(w, s); err != nil || n != len(s) {
+					t.Errorf("%q: write %q got (%d, %v)", gold.Writes, s, n, err)
+				}
+			}
+			err := w.Close()
+			conn.Close()
+			frames := <-done
+
+			if !gold.Valid {
+				if err != ErrUTF8 {
+					t.Errorf("%q: got close error %v, want %v", gold.Writes, err, ErrUTF8)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%q: close error: %s", gold.Writes, err)
+				continue
+			}
+
+			// parse frames
+			r := NewReader(make([]byte, 4096))
+			r.ReadSome(strings.NewReader(frames))
+			var message []byte
+			for {
+				payload, err := r.NextFrame()
+				if err != nil {
+					t.Fatalf("%q: frame error: %s", gold.Writes, err)
+				}
+				if !utf8.Valid(payload) {
+					t.Errorf("%q: frame payload %q splits a rune", gold.Writes, payload)
+				}
+				message = append(message, payload...)
+				if r.IsFinal() {
+					break
+				}
+			}
+			if want := strings.Join(gold.Writes, ""); string(message) != want {
+				t.Errorf("%q: got message %q, want %q", gold.Writes, message, want)
+			}
+		}
+	}
+}
+
+var GoldenEmptyFragments = [][]string{
+	{"", ""},
+	{"", "héllo"},
+	{"héllo", ""},
+	{"", "", "x"},
+	{"", "é", ""},
+}
+
+func TestReceiveEmptyFragments(t *testing.T) {
+	for _, gold := range GoldenEmptyFragments {
+		conn, testEnd := pipeConn()
+		go io.WriteString(testEnd, fragmentedText(gold...))
+
+		var buf [16]byte
+		opcode, n, err := conn.Receive(buf[:], time.Second, time.Second)
+		if err != nil {
+			t.Errorf("%q: receive error: %s", gold, err)
+			continue
+		}
+		if opcode != Text {
+			t.Errorf("%q: got opcode %d, want text", gold, opcode)
+		}
+		if got, want := string(buf[:n]), strings.Join(gold, ""); got != want {
+			t.Errorf("%q: got %q, want %q", gold, got, want)
+		}
+	}
+}
+
+func TestReceiveStreamEmptyFragments(t *testing.T) {
+	for _, gold := range GoldenEmptyFragments {
+		// read with buffer sizes smaller than, equal to and larger than
+		// the two-byte rune
+		for _, bufSize := range []int{1, 2, 16} {
+			conn, testEnd := pipeConn()
+			go io.WriteString(testEnd, fragmentedText(gold...))
+
+			opcode, r, err := conn.ReceiveStream(time.Second, time.Second)
+			if err != nil {
+				t.Errorf("%q: receive error: %s", gold, err)
+				continue
+			}
+			if opcode != Text {
+				t.Errorf("%q: got opcode %d, want text", gold, opcode)
+			}
+
+			var got []byte
+			buf := make([]byte, bufSize)
+			for {
+				n, err := r.Read(buf)
+				got = append(got, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Errorf("%q: read with %d-byte buffer got error: %s", gold, bufSize, err)
+					break
+				}
+			}
+			if want := strings.Join(gold, ""); string(got) != want {
+				t.Errorf("%q: read with %d-byte buffer got %q, want %q", gold, bufSize, got, want)
+			}
+		}
+	}
+}
+
+func TestCloseNow(t *testing.T) {
+	conn, testEnd := pipeConn()
+
+	done := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(testEnd)
+		done <- b
+	}()
+
+	if err := conn.CloseNow(); err != nil {
+		t.Error("close error:", err)
+	}
+	if got := <-done; len(got) != 0 {
+		t.Errorf("test end got %q, want nothing", got)
+	}
+	if _, err := conn.Write(nil); err != ClosedError(AbnormalClose) {
+		t.Errorf("write after CloseNow got error %v, want %v", err, ClosedError(AbnormalClose))
+	}
+}
@@ -0,0 +1,89 @@
+// Package websockettest provides utilities for testing with WebSockets.
+package websockettest
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/pascaldekloe/websocket"
+)
+
+// Client is the peer of a server connection. Frames are send with a mask,
+// conform the client role. The websocket.Conn implements the server role only.
+type Client struct {
+	net.Conn
+	r *websocket.Reader
+}
+
+// NewPipe returns a server connection with its client, over an in-memory pipe.
+// Both ends are closed when t completes, conform t.Cleanup. Use deadlines on
+// either end as a protection against hanging tests.
+func NewPipe(t testing.TB) (*websocket.Conn, *Client) {
+	serverEnd, clientEnd := net.Pipe()
+	t.Cleanup(func() {
+		serverEnd.Close()
+		clientEnd.Close()
+	})
+
+	return &websocket.Conn{Conn: serverEnd}, &Client{
+		Conn: clientEnd,
+		r:    websocket.NewReader(make([]byte, 14+1<<16)),
+	}
+}
+
+// Send transmits payload in one frame with a random mask. The head is the first
+// byte of the frame, i.e., the opcode with the final flag (0x80), and with any
+// reserved bits (0x70).
+func (c *Client) Send(head byte, payload []byte) error {
+	frame := make([]byte, 14+len(payload))
+	frame[0] = head
+	var i int
+	switch {
+	case len(payload) < 126:
+		frame[1] = 0x80 | byte(len(payload))
+		i = 2
+	case len(payload) < 1<<16:
+		frame[1] = 0x80 | 126
+		binary.BigEndian.PutUint16(frame[2:4], uint16(len(payload)))
+		i = 4
+	default:
+		frame[1] = 0x80 | 127
+		binary.BigEndian.PutUint64(frame[2:10], uint64(len(payload)))
+		i = 10
+	}
+	mask := frame[i : i+4]
+	binary.BigEndian.PutUint32(mask, rand.Uint32())
+	i += 4
+
+	for j, b := range payload {
+		frame[i+j] = b ^ mask[j&3]
+	}
+	_, err := c.Write(frame[:i+len(payload)])
+	return err
+}
+
+// SendMessage transmits payload as one final frame.
+func (c *Client) SendMessage(opcode uint, payload []byte) error {
+	return c.Send(0x80|byte(opcode), payload)
+}
+
+// Receive reads the next frame from the server. The payload remains valid until
+// the next Receive. Frames beyond 64 KiB in size are rejected with the
+// websocket.ErrOverflow.
+func (c *Client) Receive() (opcode uint, final bool, payload []byte, err error) {
+	for {
+		payload, err = c.r.NextFrame()
+		if err != websocket.ErrUnderflow {
+			break
+		}
+		if err = c.r.ReadSome(c.Conn); err != nil {
+			return 0, false, nil, err
+		}
+	}
+	if err != nil && err != websocket.ErrReserved {
+		return 0, false, nil, err
+	}
+	return c.r.Opcode(), c.r.IsFinal(), payload, err
+}
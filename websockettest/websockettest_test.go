@@ -0,0 +1,41 @@
+package websockettest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/websocket"
+)
+
+func TestPipe(t *testing.T) {
+	conn, client := NewPipe(t)
+	// protection against hanging test
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+
+	for _, message := range []string{"", "hello", strings.Repeat("!", 126), strings.Repeat("?", 1<<16)} {
+		go func(message string) {
+			if err := client.SendMessage(websocket.Text, []byte(message)); err != nil {
+				t.Error("client send error:", err)
+			}
+		}(message)
+
+		buf := make([]byte, len(message)+1)
+		opcode, n, err := conn.Receive(buf, time.Second, time.Second)
+		if err != nil {
+			t.Fatal("server receive error:", err)
+		}
+		if opcode != websocket.Text || string(buf[:n]) != message {
+			t.Errorf("server got opcode %d with %d bytes, want Text with %d bytes", opcode, n, len(message))
+		}
+	}
+
+	go conn.Send(websocket.Binary, []byte("reply"), time.Second)
+	opcode, final, payload, err := client.Receive()
+	if err != nil {
+		t.Fatal("client receive error:", err)
+	}
+	if opcode != websocket.Binary || !final || string(payload) != "reply" {
+		t.Errorf("client got opcode %d, final %t, payload %q; want Binary, true, \"reply\"", opcode, final, payload)
+	}
+}